@@ -0,0 +1,301 @@
+package indialights
+
+// Column files hold one float64 value per village or darkspot for a
+// single date and chunk.  A column is stored either densely, as a
+// gzipped stream of little-endian float64 values (the ziparray
+// format), or sparsely, as a gzipped stream containing the column
+// length n, the number of observed (non-NaN) values m, then m int64
+// positions followed by m float64 values.  Positions that are not
+// listed in a sparse file are NaN.
+//
+// Dense columns are stored in files named "xxx_##.gz", sparse columns
+// are stored in files named "xxx_##.sparse.gz".  Callers always refer
+// to the dense name, ReadColumn and OpenColumn locate whichever file
+// is present.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kshedden/ziparray"
+)
+
+// SparseName returns the name of the sparse file corresponding to
+// the given dense column file name.
+func SparseName(fname string) string {
+	return strings.TrimSuffix(fname, ".gz") + ".sparse.gz"
+}
+
+// WriteColumn writes vec to the column file fname.  If the fraction
+// of non-NaN values in vec is less than maxdensity the sparse format
+// is used, otherwise the dense format is used.  Any existing file in
+// the other format is removed.
+func WriteColumn(vec []float64, fname string, maxdensity float64) error {
+
+	nobs := 0
+	for _, v := range vec {
+		if !math.IsNaN(v) {
+			nobs++
+		}
+	}
+
+	sname := SparseName(fname)
+	if len(vec) == 0 || float64(nobs) >= maxdensity*float64(len(vec)) {
+		err := os.Remove(sname)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return ziparray.WriteFloat64Array(vec, fname)
+	}
+
+	err := os.Remove(fname)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return writeSparse(vec, nobs, sname)
+}
+
+// RemoveColumn removes the column file fname, in either format.  It
+// is not an error if there is no such file.
+func RemoveColumn(fname string) error {
+	for _, f := range []string{fname, SparseName(fname)} {
+		err := os.Remove(f)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSparse(vec []float64, nobs int, fname string) error {
+
+	idx := make([]int64, 0, nobs)
+	val := make([]float64, 0, nobs)
+	for i, v := range vec {
+		if !math.IsNaN(v) {
+			idx = append(idx, int64(i))
+			val = append(val, v)
+		}
+	}
+
+	fid, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	gid := gzip.NewWriter(fid)
+
+	for _, x := range []interface{}{int64(len(vec)), int64(nobs), idx, val} {
+		err = binary.Write(gid, binary.LittleEndian, x)
+		if err != nil {
+			gid.Close()
+			return err
+		}
+	}
+
+	return gid.Close()
+}
+
+// readSparse reads a sparse column file, returning the column
+// length, the observed positions and the observed values.
+func readSparse(fname string) (int64, []int64, []float64, error) {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer fid.Close()
+	gid, err := gzip.NewReader(fid)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer gid.Close()
+	rdr := bufio.NewReader(gid)
+
+	var n, nobs int64
+	err = binary.Read(rdr, binary.LittleEndian, &n)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	err = binary.Read(rdr, binary.LittleEndian, &nobs)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if nobs < 0 || nobs > n {
+		return 0, nil, nil, fmt.Errorf("%s: invalid sparse header n=%d nobs=%d", fname, n, nobs)
+	}
+
+	idx := make([]int64, nobs)
+	val := make([]float64, nobs)
+	err = binary.Read(rdr, binary.LittleEndian, idx)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	err = binary.Read(rdr, binary.LittleEndian, val)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	return n, idx, val, nil
+}
+
+// ReadColumn reads a column file written by WriteColumn, in either
+// format, and returns it as a dense array.  fname is the dense file
+// name.  If neither file exists the error satisfies os.IsNotExist.
+func ReadColumn(fname string) ([]float64, error) {
+
+	_, err := os.Stat(fname)
+	if err == nil {
+		return ziparray.ReadFloat64Array(fname)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	sname := SparseName(fname)
+	if _, serr := os.Stat(sname); serr != nil {
+		// Report the missing dense file
+		return nil, err
+	}
+
+	n, idx, val, err := readSparse(sname)
+	if err != nil {
+		return nil, err
+	}
+	vec := make([]float64, n)
+	for i := range vec {
+		vec[i] = math.NaN()
+	}
+	for j, i := range idx {
+		if i < 0 || i >= n {
+			return nil, fmt.Errorf("%s: position %d out of range", sname, i)
+		}
+		vec[i] = val[j]
+	}
+
+	return vec, nil
+}
+
+// ColumnReader returns the values of a column file one at a time.
+// Dense files are held in memory in compressed form and decompressed
+// as they are read, sparse files are held in decoded form.
+type ColumnReader struct {
+
+	// Dense columns
+	gid *gzip.Reader
+	rdr *bufio.Reader
+	b   [8]byte
+
+	// Sparse columns
+	sparse bool
+	n      int64
+	pos    int64
+	idx    []int64
+	val    []float64
+	next   int
+}
+
+// OpenColumn opens a column file in either format for sequential
+// reading.  fname is the dense file name.  If neither file exists the
+// error satisfies os.IsNotExist.
+func OpenColumn(fname string) (*ColumnReader, error) {
+
+	dat, err := ioutil.ReadFile(fname)
+	if err == nil {
+		gid, err := gzip.NewReader(bytes.NewReader(dat))
+		if err != nil {
+			return nil, err
+		}
+		return &ColumnReader{gid: gid, rdr: bufio.NewReader(gid)}, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	sname := SparseName(fname)
+	if _, serr := os.Stat(sname); serr != nil {
+		return nil, err
+	}
+	n, idx, val, err := readSparse(sname)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ColumnReader{sparse: true, n: n, idx: idx, val: val}, nil
+}
+
+// Next returns the next value in the column, or io.EOF when the
+// column is exhausted.
+func (c *ColumnReader) Next() (float64, error) {
+
+	if !c.sparse {
+		_, err := io.ReadFull(c.rdr, c.b[:])
+		if err == io.ErrUnexpectedEOF {
+			return 0, fmt.Errorf("truncated column file")
+		} else if err != nil {
+			return 0, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(c.b[:])), nil
+	}
+
+	if c.pos >= c.n {
+		return 0, io.EOF
+	}
+	v := math.NaN()
+	if c.next < len(c.idx) && c.idx[c.next] == c.pos {
+		v = c.val[c.next]
+		c.next++
+	}
+	c.pos++
+
+	return v, nil
+}
+
+// Close releases the resources held by the reader.
+func (c *ColumnReader) Close() error {
+	if c.gid != nil {
+		return c.gid.Close()
+	}
+	return nil
+}
+
+// ReadDarkspotColumn reads the n darkspot vis values for the date
+// directory dir, concatenating the chunks vis_observed_00,
+// vis_observed_01, ... in order.  It is an error if the chunks hold
+// more or fewer than n values, or if there is a chunk past the one
+// holding the last value.  If there is no first chunk the error
+// satisfies os.IsNotExist.
+func ReadDarkspotColumn(dir string, n int) ([]float64, error) {
+
+	dvec := make([]float64, 0, n)
+	chunk_idx := 0
+	for ; len(dvec) < n || chunk_idx == 0; chunk_idx++ {
+		fname := filepath.Join(dir, fmt.Sprintf("vis_observed_%02d.gz", chunk_idx))
+		vec, err := ReadColumn(fname)
+		if os.IsNotExist(err) && chunk_idx > 0 {
+			return nil, fmt.Errorf("%s: found %d darkspots in %d chunks, expected %d", dir, len(dvec), chunk_idx, n)
+		} else if err != nil {
+			return nil, err
+		}
+		dvec = append(dvec, vec...)
+	}
+
+	if len(dvec) != n {
+		return nil, fmt.Errorf("%s: found %d darkspots in %d chunks, expected %d", dir, len(dvec), chunk_idx, n)
+	}
+	fname := filepath.Join(dir, fmt.Sprintf("vis_observed_%02d.gz", chunk_idx))
+	for _, f := range []string{fname, SparseName(fname)} {
+		if _, err := os.Stat(f); err == nil {
+			return nil, fmt.Errorf("%s: unexpected chunk %s after %d darkspots", dir, filepath.Base(f), n)
+		}
+	}
+
+	return dvec, nil
+}
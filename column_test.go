@@ -0,0 +1,138 @@
+package indialights
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// same_column returns true if a and b are identical, treating all
+// NaNs as equal.
+func same_column(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] && !(math.IsNaN(a[i]) && math.IsNaN(b[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestColumnRoundTrip(t *testing.T) {
+
+	nan := math.NaN()
+	vecs := map[string][]float64{
+		"empty":  {},
+		"dense":  {1, 2.5, nan, -3, 0},
+		"sparse": {nan, nan, 7, nan, nan, nan, nan, nan, nan, 1e-9},
+		"allnan": {nan, nan, nan},
+	}
+
+	dir := t.TempDir()
+	for name, vec := range vecs {
+		for _, maxdensity := range []float64{0, 0.5, 1.01} {
+			fname := filepath.Join(dir, name+".gz")
+			if err := WriteColumn(vec, fname, maxdensity); err != nil {
+				t.Fatal(err)
+			}
+
+			// Only one of the two files is present
+			_, err1 := os.Stat(fname)
+			_, err2 := os.Stat(SparseName(fname))
+			if (err1 == nil) == (err2 == nil) {
+				t.Fatalf("%s %v: expected exactly one column file", name, maxdensity)
+			}
+
+			x, err := ReadColumn(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !same_column(x, vec) {
+				t.Fatalf("%s %v: ReadColumn gave %v, expected %v", name, maxdensity, x, vec)
+			}
+
+			c, err := OpenColumn(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var y []float64
+			for {
+				v, err := c.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				y = append(y, v)
+			}
+			c.Close()
+			if !same_column(y, vec) {
+				t.Fatalf("%s %v: OpenColumn gave %v, expected %v", name, maxdensity, y, vec)
+			}
+		}
+	}
+}
+
+func TestColumnMissing(t *testing.T) {
+
+	fname := filepath.Join(t.TempDir(), "x_00.gz")
+	if _, err := ReadColumn(fname); !os.IsNotExist(err) {
+		t.Fatalf("ReadColumn: expected a not exist error, got %v", err)
+	}
+	if _, err := OpenColumn(fname); !os.IsNotExist(err) {
+		t.Fatalf("OpenColumn: expected a not exist error, got %v", err)
+	}
+
+	// Removing a missing column is not an error
+	if err := RemoveColumn(fname); err != nil {
+		t.Fatal(err)
+	}
+	for _, maxdensity := range []float64{0, 1.01} {
+		if err := WriteColumn([]float64{1, math.NaN()}, fname, maxdensity); err != nil {
+			t.Fatal(err)
+		}
+		if err := RemoveColumn(fname); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadColumn(fname); !os.IsNotExist(err) {
+			t.Fatalf("column not removed: %v", err)
+		}
+	}
+}
+
+func TestReadDarkspotColumn(t *testing.T) {
+
+	nan := math.NaN()
+	dir := t.TempDir()
+	chunks := [][]float64{{1, nan, 3}, {nan, nan, nan}, {7}}
+	for k, vec := range chunks {
+		fname := filepath.Join(dir, fmt.Sprintf("vis_observed_%02d.gz", k))
+		if err := WriteColumn(vec, fname, 0.5); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	x, err := ReadDarkspotColumn(dir, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same_column(x, []float64{1, nan, 3, nan, nan, nan, 7}) {
+		t.Fatalf("got %v", x)
+	}
+
+	// Too many or too few values, or a chunk past the last value
+	for _, n := range []int{0, 3, 5, 8} {
+		if _, err := ReadDarkspotColumn(dir, n); err == nil {
+			t.Errorf("n=%d: expected an error", n)
+		}
+	}
+
+	if _, err := ReadDarkspotColumn(t.TempDir(), 7); !os.IsNotExist(err) {
+		t.Fatalf("expected a not exist error, got %v", err)
+	}
+}
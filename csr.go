@@ -0,0 +1,239 @@
+package indialights
+
+// Compressed sparse row (CSR) storage of the village/darkspot matches.
+//
+// The file is uncompressed and little-endian, so that it can be
+// memory-mapped and used without decoding.  It contains:
+//
+//   8 bytes: the magic string "ILCSR001"
+//   int64: the number of villages n
+//   int64: the total number of matches m
+//   int64: 1 if the file contains distances, otherwise 0
+//   (n+1) int64: offsets, village i is matched to the darkspots at
+//       positions offsets[i] to offsets[i+1]-1 of the index array
+//   m int64: the darkspot index of each match
+//   m float64 (optional): the distance in meters of each match
+//
+// All sections start at multiples of 8 bytes.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	csr_magic = "ILCSR001"
+
+	// Size of the header in bytes
+	csr_header = 32
+)
+
+// MatchCSR holds the matches in compressed sparse row form.
+type MatchCSR struct {
+	Offsets []int64
+	Index   []int64
+
+	// Distances in meters, nil if the file has no distances
+	Dist []float64
+
+	// Releases the memory mapping, if any
+	unmap func() error
+}
+
+// WriteMatchCSR writes the matches, and the distances if dists is not
+// nil, to a CSR file.
+func WriteMatchCSR(fname string, matches [][]int64, dists [][]float64) error {
+
+	fid, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	wtr := bufio.NewWriter(fid)
+
+	m := int64(0)
+	offsets := make([]int64, len(matches)+1)
+	for i, ix := range matches {
+		if dists != nil && len(dists[i]) != len(ix) {
+			return fmt.Errorf("village %d has %d matches and %d distances", i, len(ix), len(dists[i]))
+		}
+		m += int64(len(ix))
+		offsets[i+1] = m
+	}
+	hasdist := int64(0)
+	if dists != nil {
+		hasdist = 1
+	}
+
+	_, err = wtr.WriteString(csr_magic)
+	if err != nil {
+		return err
+	}
+	for _, x := range []interface{}{int64(len(matches)), m, hasdist, offsets} {
+		err = binary.Write(wtr, binary.LittleEndian, x)
+		if err != nil {
+			return err
+		}
+	}
+	for _, ix := range matches {
+		err = binary.Write(wtr, binary.LittleEndian, ix)
+		if err != nil {
+			return err
+		}
+	}
+	for _, dx := range dists {
+		err = binary.Write(wtr, binary.LittleEndian, dx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return wtr.Flush()
+}
+
+// csr_sizes reads the header of a CSR file, returning the number of
+// villages, the number of matches and whether there are distances.
+func csr_sizes(hdr []byte, fsize int64) (int64, int64, bool, error) {
+
+	if len(hdr) < csr_header || string(hdr[0:8]) != csr_magic {
+		return 0, 0, false, fmt.Errorf("not a CSR match file")
+	}
+	n := int64(binary.LittleEndian.Uint64(hdr[8:16]))
+	m := int64(binary.LittleEndian.Uint64(hdr[16:24]))
+	hasdist := binary.LittleEndian.Uint64(hdr[24:32]) == 1
+
+	size := csr_header + 8*(n+1+m)
+	if hasdist {
+		size += 8 * m
+	}
+	if n < 0 || m < 0 || size != fsize {
+		return 0, 0, false, fmt.Errorf("CSR match file has size %d, expected %d", fsize, size)
+	}
+
+	return n, m, hasdist, nil
+}
+
+// ReadMatchCSR reads a CSR file by streaming it into memory.  It is
+// an error if a darkspot index is not in [0, ndarkspot).
+func ReadMatchCSR(fname string, ndarkspot int) (*MatchCSR, error) {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+	stat, err := fid.Stat()
+	if err != nil {
+		return nil, err
+	}
+	rdr := bufio.NewReader(fid)
+
+	hdr := make([]byte, csr_header)
+	_, err = io.ReadFull(rdr, hdr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+	n, m, hasdist, err := csr_sizes(hdr, stat.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+
+	mc := &MatchCSR{Offsets: make([]int64, n+1), Index: make([]int64, m)}
+	if hasdist {
+		mc.Dist = make([]float64, m)
+	}
+	data := []interface{}{mc.Offsets, mc.Index}
+	if hasdist {
+		data = append(data, mc.Dist)
+	}
+	for _, x := range data {
+		err = binary.Read(rdr, binary.LittleEndian, x)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fname, err)
+		}
+	}
+
+	if err := mc.check(ndarkspot); err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+
+	return mc, nil
+}
+
+// check verifies that the offsets are consistent and that the
+// darkspot indices are in [0, ndarkspot).
+func (mc *MatchCSR) check(ndarkspot int) error {
+
+	m := int64(len(mc.Index))
+	if mc.Offsets[0] != 0 || mc.Offsets[len(mc.Offsets)-1] != m {
+		return fmt.Errorf("invalid CSR offsets")
+	}
+	for i := 1; i < len(mc.Offsets); i++ {
+		if mc.Offsets[i] < mc.Offsets[i-1] {
+			return fmt.Errorf("invalid CSR offsets")
+		}
+	}
+	for _, i := range mc.Index {
+		if i < 0 || i >= int64(ndarkspot) {
+			return fmt.Errorf("darkspot index %d out of range, there are %d darkspots", i, ndarkspot)
+		}
+	}
+
+	return nil
+}
+
+// Len returns the number of villages.
+func (mc *MatchCSR) Len() int {
+	return len(mc.Offsets) - 1
+}
+
+// Row returns the darkspots matched to village i.
+func (mc *MatchCSR) Row(i int) []int64 {
+	a, b := mc.Offsets[i], mc.Offsets[i+1]
+	return mc.Index[a:b:b]
+}
+
+// RowDist returns the distances of the darkspots matched to village
+// i, or nil if there are no distances.
+func (mc *MatchCSR) RowDist(i int) []float64 {
+	if mc.Dist == nil {
+		return nil
+	}
+	a, b := mc.Offsets[i], mc.Offsets[i+1]
+	return mc.Dist[a:b:b]
+}
+
+// Rows returns the matches in the form used by ReadMatches, with each
+// village's matches referring to the CSR storage.
+func (mc *MatchCSR) Rows() [][]int64 {
+	rows := make([][]int64, mc.Len())
+	for i := range rows {
+		rows[i] = mc.Row(i)
+	}
+	return rows
+}
+
+// RowDists returns the distances in the form used by ReadMatchDists,
+// or nil if there are no distances.
+func (mc *MatchCSR) RowDists() [][]float64 {
+	if mc.Dist == nil {
+		return nil
+	}
+	rows := make([][]float64, mc.Len())
+	for i := range rows {
+		rows[i] = mc.RowDist(i)
+	}
+	return rows
+}
+
+// Close releases the memory mapping of a file opened with
+// OpenMatchCSR.  The matches cannot be used after calling Close.
+func (mc *MatchCSR) Close() error {
+	if mc.unmap != nil {
+		return mc.unmap()
+	}
+	return nil
+}
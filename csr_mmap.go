@@ -0,0 +1,80 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package indialights
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// OpenMatchCSR memory-maps a CSR file.  The offsets, indices and
+// distances refer directly to the mapped file, so opening is fast
+// and the matches are paged in as they are used.  If the host is not
+// little-endian the file is read with ReadMatchCSR instead.  It is an
+// error if a darkspot index is not in [0, ndarkspot).
+func OpenMatchCSR(fname string, ndarkspot int) (*MatchCSR, error) {
+
+	var x uint16 = 1
+	if *(*byte)(unsafe.Pointer(&x)) != 1 {
+		return ReadMatchCSR(fname, ndarkspot)
+	}
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+	stat, err := fid.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() < csr_header {
+		return nil, fmt.Errorf("%s: not a CSR match file", fname)
+	}
+	if int64(int(stat.Size())) != stat.Size() {
+		return nil, fmt.Errorf("%s: too large to map", fname)
+	}
+
+	b, err := syscall.Mmap(int(fid.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+	n, m, hasdist, err := csr_sizes(b, stat.Size())
+	if err != nil {
+		syscall.Munmap(b)
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+
+	mc := &MatchCSR{unmap: func() error { return syscall.Munmap(b) }}
+	pos := int64(csr_header)
+	mc.Offsets = int64_view(b[pos:], n+1)
+	pos += 8 * (n + 1)
+	mc.Index = int64_view(b[pos:], m)
+	pos += 8 * m
+	if hasdist {
+		mc.Dist = float64_view(b[pos:], m)
+	}
+	if err := mc.check(ndarkspot); err != nil {
+		mc.Close()
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+
+	return mc, nil
+}
+
+func int64_view(b []byte, n int64) []int64 {
+	if n == 0 {
+		return []int64{}
+	}
+	return unsafe.Slice((*int64)(unsafe.Pointer(&b[0])), n)
+}
+
+func float64_view(b []byte, n int64) []float64 {
+	if n == 0 {
+		return []float64{}
+	}
+	return unsafe.Slice((*float64)(unsafe.Pointer(&b[0])), n)
+}
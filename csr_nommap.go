@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package indialights
+
+// OpenMatchCSR reads a CSR file.  Memory mapping is not supported on
+// this platform, so the file is read with ReadMatchCSR.
+func OpenMatchCSR(fname string, ndarkspot int) (*MatchCSR, error) {
+	return ReadMatchCSR(fname, ndarkspot)
+}
@@ -0,0 +1,118 @@
+package indialights
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func check_csr(t *testing.T, mc *MatchCSR, matches [][]int64, dists [][]float64) {
+
+	if mc.Len() != len(matches) {
+		t.Fatalf("got %d villages, expected %d", mc.Len(), len(matches))
+	}
+	for i, ix := range matches {
+		if len(ix) == 0 && len(mc.Row(i)) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(mc.Row(i), ix) {
+			t.Fatalf("village %d: got %v, expected %v", i, mc.Row(i), ix)
+		}
+	}
+
+	if dists == nil {
+		if mc.RowDists() != nil {
+			t.Fatalf("expected no distances")
+		}
+		return
+	}
+	for i, dx := range dists {
+		if len(dx) == 0 && len(mc.RowDist(i)) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(mc.RowDist(i), dx) {
+			t.Fatalf("village %d: got distances %v, expected %v", i, mc.RowDist(i), dx)
+		}
+	}
+}
+
+func TestMatchCSRRoundTrip(t *testing.T) {
+
+	cases := []struct {
+		matches [][]int64
+		dists   [][]float64
+	}{
+		{[][]int64{}, nil},
+		{[][]int64{}, [][]float64{}},
+		{[][]int64{{}, {}}, nil},
+		{[][]int64{{3, 1, 2}, {}, {0, 5}}, nil},
+		{[][]int64{{3, 1, 2}, {}, {0, 5}}, [][]float64{{10, 5.5, 7}, {}, {0, 1e6}}},
+	}
+
+	dir := t.TempDir()
+	for k, c := range cases {
+		fname := filepath.Join(dir, "matches.csr")
+		if err := WriteMatchCSR(fname, c.matches, c.dists); err != nil {
+			t.Fatal(err)
+		}
+
+		mc, err := ReadMatchCSR(fname, 6)
+		if err != nil {
+			t.Fatalf("case %d: %v", k, err)
+		}
+		check_csr(t, mc, c.matches, c.dists)
+
+		mc, err = OpenMatchCSR(fname, 6)
+		if err != nil {
+			t.Fatalf("case %d: %v", k, err)
+		}
+		check_csr(t, mc, c.matches, c.dists)
+		if err := mc.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMatchCSRInvalid(t *testing.T) {
+
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "matches.csr")
+	if err := WriteMatchCSR(fname, [][]int64{{1, 2}, {3}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A truncated file
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fname, b[0:len(b)-8], 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadMatchCSR(fname, 4); err == nil {
+		t.Fatalf("ReadMatchCSR: expected an error for a truncated file")
+	}
+	if _, err := OpenMatchCSR(fname, 4); err == nil {
+		t.Fatalf("OpenMatchCSR: expected an error for a truncated file")
+	}
+
+	// Darkspot indices out of range
+	for _, matches := range [][][]int64{{{1, 2}, {3}}, {{1, -1}, {2}}} {
+		if err := WriteMatchCSR(fname, matches, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadMatchCSR(fname, 3); err == nil {
+			t.Fatalf("ReadMatchCSR: expected an error for %v", matches)
+		}
+		if _, err := OpenMatchCSR(fname, 3); err == nil {
+			t.Fatalf("OpenMatchCSR: expected an error for %v", matches)
+		}
+	}
+
+	// Mismatched distances
+	err = WriteMatchCSR(fname, [][]int64{{1, 2}}, [][]float64{{1}})
+	if err == nil {
+		t.Fatalf("WriteMatchCSR: expected an error for mismatched distances")
+	}
+}
@@ -0,0 +1,368 @@
+package indialights
+
+// Estimators of the background vis level of a village, calculated from
+// the vis values of its matched darkspots on one date.
+//
+// All estimators take the values sorted in increasing order, and
+// optionally a positive weight for each value.  Weighted estimators
+// use weighted quantiles in place of order statistics.
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// BackgroundEstimator calculates a location estimate from the sorted
+// darkspot values vals matched to one village.  wts is either nil,
+// or contains a positive weight for each value.  Estimate returns NaN
+// if there are no values, and does not modify vals or wts.
+type BackgroundEstimator interface {
+
+	// Name of the output variable holding the estimates
+	Name() string
+
+	Estimate(vals, wts []float64) float64
+}
+
+// NewEstimator returns the background estimator with the given name,
+// one of "median", "winsor", "huber" or "quantile".  The winsorized
+// mean uses conf.MatchLower and conf.MatchUpper, the Huber estimate
+// uses conf.HuberK, and the quantile estimate uses conf.BgQuantile.
+// The trimmed mean is not an additional estimator, since it is always
+// calculated (see TrimmedMean).
+func NewEstimator(name string, conf *Conf) (BackgroundEstimator, error) {
+
+	switch name {
+	case "tmean":
+		return nil, fmt.Errorf("the trimmed mean is always calculated, tmean is not an additional estimator")
+	case "median":
+		return &quantile_est{"bg_median", 0.5}, nil
+	case "winsor":
+		return &winsor_est{conf.MatchLower, conf.MatchUpper}, nil
+	case "huber":
+		k := conf.HuberK
+		if k <= 0 {
+			k = 1.345
+		}
+		return &huber_est{k}, nil
+	case "quantile":
+		if conf.BgQuantile <= 0 || conf.BgQuantile >= 1 {
+			return nil, fmt.Errorf("BgQuantile must be between 0 and 1")
+		}
+		return &quantile_est{"bg_quantile", conf.BgQuantile}, nil
+	}
+
+	return nil, fmt.Errorf("unknown background estimator %s", name)
+}
+
+// TrimmedMean returns the mean of the sorted values vals between the
+// p1 and p2 quantiles, the number of values retained, and the
+// standard deviation of the retained values.  If wts is not nil, the
+// values whose cumulative weight lies between the p1 and p2 weighted
+// quantiles are retained, each value is given its weight multiplied
+// by the fraction of that weight lying between the quantiles, and the
+// count is the number of values given positive weight.
+func TrimmedMean(vals, wts []float64, p1, p2 float64) (float64, int, float64) {
+
+	if wts != nil {
+		return weighted_tmean(vals, wts, p1, p2)
+	}
+
+	tmean := float64(0)
+	n := int(0)
+	m := len(vals)
+	j1 := int(float64(m) * p1)
+	j2 := int(float64(m) * p2)
+	for i := j1; i < j2; i++ {
+		tmean += vals[i]
+		n++
+	}
+	tmean /= float64(n)
+
+	sd := float64(0)
+	for i := j1; i < j2; i++ {
+		u := vals[i] - tmean
+		sd += u * u
+	}
+	sd = math.Sqrt(sd / float64(n))
+
+	return tmean, n, sd
+}
+
+// trim_weight returns the part of the weight w, with cumulative weight
+// cw before it, lying between lw and uw.
+func trim_weight(cw, w, lw, uw float64) float64 {
+	a := math.Max(cw, lw)
+	b := math.Min(cw+w, uw)
+	if b > a {
+		return b - a
+	}
+	return 0
+}
+
+func weighted_tmean(vals, wts []float64, p1, p2 float64) (float64, int, float64) {
+
+	tw := float64(0)
+	for _, w := range wts {
+		tw += w
+	}
+	lw := p1 * tw
+	uw := p2 * tw
+
+	n := 0
+	cw := float64(0)
+	tmean := float64(0)
+	sw := float64(0)
+	for i, v := range vals {
+		w := trim_weight(cw, wts[i], lw, uw)
+		cw += wts[i]
+		if w > 0 {
+			n++
+		}
+		tmean += w * v
+		sw += w
+	}
+	tmean /= sw
+
+	cw = 0
+	sd := float64(0)
+	for i, v := range vals {
+		w := trim_weight(cw, wts[i], lw, uw)
+		cw += wts[i]
+		u := v - tmean
+		sd += w * u * u
+	}
+	sd = math.Sqrt(sd / sw)
+
+	return tmean, n, sd
+}
+
+// Quantile returns the p quantile of the sorted values vals.
+// Unweighted quantiles interpolate linearly between order statistics.
+// Weighted quantiles are the smallest value whose cumulative weight
+// is at least p times the total weight, and are NaN if the total
+// weight is zero.
+func Quantile(vals, wts []float64, p float64) float64 {
+
+	m := len(vals)
+	if m == 0 {
+		return math.NaN()
+	}
+
+	if wts == nil {
+		h := p * float64(m-1)
+		j := int(math.Floor(h))
+		if j >= m-1 {
+			return vals[m-1]
+		}
+		return vals[j] + (h-float64(j))*(vals[j+1]-vals[j])
+	}
+
+	tw := float64(0)
+	for _, w := range wts {
+		tw += w
+	}
+	if tw <= 0 {
+		return math.NaN()
+	}
+	cw := float64(0)
+	for i, w := range wts {
+		cw += w
+		if cw >= p*tw {
+			return vals[i]
+		}
+	}
+
+	return vals[m-1]
+}
+
+// Sort values and weights together by value
+type wvals struct {
+	vals []float64
+	wts  []float64
+}
+
+func (a wvals) Len() int           { return len(a.vals) }
+func (a wvals) Less(i, j int) bool { return a.vals[i] < a.vals[j] }
+func (a wvals) Swap(i, j int) {
+	a.vals[i], a.vals[j] = a.vals[j], a.vals[i]
+	a.wts[i], a.wts[j] = a.wts[j], a.wts[i]
+}
+
+// SortWeighted sorts vals in increasing order, permuting wts in the
+// same way.
+func SortWeighted(vals, wts []float64) {
+	sort.Sort(wvals{vals, wts})
+}
+
+// MAD returns the median absolute deviation of the sorted values vals
+// from their median, multiplied by 1.4826 so that it estimates the
+// standard deviation of normally distributed values.
+func MAD(vals, wts []float64) float64 {
+
+	if len(vals) == 0 {
+		return math.NaN()
+	}
+
+	med := Quantile(vals, wts, 0.5)
+	dev := make([]float64, len(vals))
+	for i, v := range vals {
+		dev[i] = math.Abs(v - med)
+	}
+	var dw []float64
+	if wts != nil {
+		dw = make([]float64, len(wts))
+		copy(dw, wts)
+		SortWeighted(dev, dw)
+	} else {
+		sort.Float64s(dev)
+	}
+
+	return 1.4826 * Quantile(dev, dw, 0.5)
+}
+
+type quantile_est struct {
+	name string
+	p    float64
+}
+
+func (e *quantile_est) Name() string {
+	return e.name
+}
+
+func (e *quantile_est) Estimate(vals, wts []float64) float64 {
+	return Quantile(vals, wts, e.p)
+}
+
+// winsor_est replaces the values below the p1 quantile and above the
+// p2 quantile with those quantiles, and returns the mean.
+type winsor_est struct {
+	p1, p2 float64
+}
+
+func (e *winsor_est) Name() string {
+	return "bg_winsor"
+}
+
+func (e *winsor_est) Estimate(vals, wts []float64) float64 {
+
+	m := len(vals)
+	if m == 0 {
+		return math.NaN()
+	}
+
+	var lo, hi float64
+	if wts == nil {
+		j1 := int(float64(m) * e.p1)
+		j2 := int(float64(m) * e.p2)
+		if j2 <= j1 {
+			j2 = j1 + 1
+		}
+		if j2 > m {
+			j2 = m
+			j1 = m - 1
+		}
+		lo = vals[j1]
+		hi = vals[j2-1]
+	} else {
+		lo, hi = winsor_limits(vals, wts, e.p1, e.p2)
+	}
+
+	mean := float64(0)
+	sw := float64(0)
+	for i, v := range vals {
+		w := float64(1)
+		if wts != nil {
+			w = wts[i]
+		}
+		mean += w * math.Min(math.Max(v, lo), hi)
+		sw += w
+	}
+
+	return mean / sw
+}
+
+// winsor_limits returns the weighted winsorizing limits.  The lower
+// limit is the first value whose cumulative weight exceeds the p1
+// weighted quantile, as in weighted_tmean, and the upper limit is the
+// last value whose cumulative weight does not exceed the p2 weighted
+// quantile.  With equal weights these are the same limits as for the
+// unweighted values.
+func winsor_limits(vals, wts []float64, p1, p2 float64) (float64, float64) {
+
+	tw := float64(0)
+	for _, w := range wts {
+		tw += w
+	}
+	lw := p1 * tw
+	uw := p2 * tw
+
+	j1, j2 := -1, -1
+	cw := float64(0)
+	for i, w := range wts {
+		cw += w
+		if j1 == -1 && cw > lw {
+			j1 = i
+		}
+		if cw <= uw {
+			j2 = i
+		}
+	}
+	if j1 == -1 {
+		j1 = len(vals) - 1
+	}
+	if j2 < j1 {
+		j2 = j1
+	}
+
+	return vals[j1], vals[j2]
+}
+
+// huber_est is the Huber M-estimate of location with tuning constant
+// k, using the normalized median absolute deviation as the scale.
+type huber_est struct {
+	k float64
+}
+
+func (e *huber_est) Name() string {
+	return "bg_huber"
+}
+
+func (e *huber_est) Estimate(vals, wts []float64) float64 {
+
+	if len(vals) == 0 {
+		return math.NaN()
+	}
+
+	mu := Quantile(vals, wts, 0.5)
+	s := MAD(vals, wts)
+	if s == 0 || math.IsNaN(s) {
+		return mu
+	}
+
+	// Iteratively reweighted least squares
+	c := e.k * s
+	for iter := 0; iter < 100; iter++ {
+		num := float64(0)
+		den := float64(0)
+		for i, v := range vals {
+			w := float64(1)
+			if wts != nil {
+				w = wts[i]
+			}
+			if u := math.Abs(v - mu); u > c {
+				w *= c / u
+			}
+			num += w * v
+			den += w
+		}
+		mu1 := num / den
+		if math.Abs(mu1-mu) < 1e-8*s {
+			return mu1
+		}
+		mu = mu1
+	}
+
+	return mu
+}
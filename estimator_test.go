@@ -0,0 +1,211 @@
+package indialights
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// close_to returns true if a and b agree to within a small tolerance,
+// treating NaNs as equal.
+func close_to(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return math.Abs(a-b) <= 1e-10*math.Max(1, math.Abs(b))
+}
+
+func ones(n int) []float64 {
+	w := make([]float64, n)
+	for i := range w {
+		w[i] = 1
+	}
+	return w
+}
+
+func TestTrimmedMean(t *testing.T) {
+
+	nan := math.NaN()
+	seq := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	cases := []struct {
+		name string
+		vals []float64
+		wts  []float64
+		mean float64
+		n    int
+		sd   float64
+	}{
+		// j1 = 0, j2 = 4
+		{"outlier", []float64{1, 2, 3, 4, 100}, nil, 2.5, 4, 1.118033988749895},
+
+		// j1 = 1, j2 = 9, with equal weights the same values are
+		// retained
+		{"seq", seq, nil, 5.5, 8, 2.29128784747792},
+		{"seq weighted", seq, ones(10), 5.5, 8, 2.29128784747792},
+
+		// The quantiles fall within the first and last values, which
+		// are given half weight
+		{"outlier weighted", []float64{1, 2, 3, 4, 100}, ones(5), 14.875, 5, 32.188652891974215},
+
+		{"equal", []float64{5, 5, 5, 5}, nil, 5, 3, 0},
+		// The first value lies entirely below the lower quantile
+		{"equal weighted", []float64{5, 5, 5, 5}, []float64{1, 2, 3, 4}, 5, 3, 0},
+
+		// j1 = j2 = 0, so no values are retained
+		{"single", []float64{7}, nil, nan, 0, nan},
+		{"single weighted", []float64{7}, []float64{2}, 7, 1, 0},
+
+		{"zero weight", []float64{1, 2}, []float64{0, 0}, nan, 0, nan},
+	}
+
+	for _, c := range cases {
+		mean, n, sd := TrimmedMean(c.vals, c.wts, 0.1, 0.9)
+		if !close_to(mean, c.mean) || n != c.n || !close_to(sd, c.sd) {
+			t.Errorf("%s: got %v, %d, %v, expected %v, %d, %v", c.name, mean, n, sd, c.mean, c.n, c.sd)
+		}
+	}
+}
+
+func TestQuantile(t *testing.T) {
+
+	nan := math.NaN()
+	v := []float64{1, 2, 3, 4}
+	cases := []struct {
+		name string
+		vals []float64
+		wts  []float64
+		p    float64
+		q    float64
+	}{
+		{"median", v, nil, 0.5, 2.5},
+		{"median weighted", v, ones(4), 0.5, 2},
+		{"weighted", v, []float64{1, 1, 1, 5}, 0.5, 4},
+		{"min", v, nil, 0, 1},
+		{"min weighted", v, ones(4), 0, 1},
+		{"max", v, nil, 1, 4},
+		{"max weighted", v, ones(4), 1, 4},
+		{"single", []float64{7}, nil, 0.3, 7},
+		{"single weighted", []float64{7}, []float64{2}, 0.3, 7},
+		{"empty", []float64{}, nil, 0.5, nan},
+		{"zero weight", v, []float64{0, 0, 0, 0}, 0.5, nan},
+	}
+
+	for _, c := range cases {
+		if q := Quantile(c.vals, c.wts, c.p); !close_to(q, c.q) {
+			t.Errorf("%s: got %v, expected %v", c.name, q, c.q)
+		}
+	}
+}
+
+func TestSortWeighted(t *testing.T) {
+
+	vals := []float64{3, 1, 2}
+	wts := []float64{30, 10, 20}
+	SortWeighted(vals, wts)
+	if !reflect.DeepEqual(vals, []float64{1, 2, 3}) || !reflect.DeepEqual(wts, []float64{10, 20, 30}) {
+		t.Errorf("got %v and %v", vals, wts)
+	}
+}
+
+func TestMAD(t *testing.T) {
+
+	// The deviations from the median 3 are 0, 1, 1, 2, 97
+	v := []float64{1, 2, 3, 4, 100}
+	if m := MAD(v, nil); !close_to(m, 1.4826) {
+		t.Errorf("got %v, expected 1.4826", m)
+	}
+	if m := MAD(v, ones(5)); !close_to(m, 1.4826) {
+		t.Errorf("weighted: got %v, expected 1.4826", m)
+	}
+	if m := MAD([]float64{5, 5, 5}, nil); m != 0 {
+		t.Errorf("equal values: got %v, expected 0", m)
+	}
+	if m := MAD([]float64{1, 2}, []float64{0, 0}); !math.IsNaN(m) {
+		t.Errorf("zero weight: got %v, expected NaN", m)
+	}
+}
+
+func TestEstimators(t *testing.T) {
+
+	nan := math.NaN()
+	conf := &Conf{MatchLower: 0.1, MatchUpper: 0.9, BgQuantile: 0.25}
+	seq := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	cases := []struct {
+		est  string
+		vals []float64
+		wts  []float64
+		want float64
+	}{
+		// Winsorized at 1 and 4 (j1 = 0, j2 = 4)
+		{"winsor", []float64{1, 2, 3, 4, 100}, nil, 2.8},
+		{"winsor", []float64{1, 2, 3, 4, 100}, ones(5), 2.8},
+
+		// Winsorized at 2 and 9
+		{"winsor", seq, nil, 5.5},
+		{"winsor", seq, ones(10), 5.5},
+		{"winsor", []float64{5, 5, 5}, nil, 5},
+		{"winsor", []float64{7}, nil, 7},
+		{"winsor", []float64{7}, []float64{2}, 7},
+		{"winsor", []float64{1, 2}, []float64{0, 0}, nan},
+
+		{"median", []float64{1, 2, 3, 4, 100}, nil, 3},
+		{"median", []float64{7}, nil, 7},
+		{"median", []float64{1, 2}, []float64{0, 0}, nan},
+
+		{"quantile", []float64{1, 2, 3, 4, 5}, nil, 2},
+		{"quantile", []float64{1, 2, 3, 4}, ones(4), 1},
+
+		// Symmetric values give the center, and a zero MAD gives
+		// the median
+		{"huber", []float64{1, 2, 3, 4, 5}, nil, 3},
+		{"huber", []float64{5, 5, 5}, nil, 5},
+		{"huber", []float64{7}, nil, 7},
+		{"huber", []float64{1, 2}, []float64{0, 0}, nan},
+	}
+
+	for _, c := range cases {
+		est, err := NewEstimator(c.est, conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x := est.Estimate(c.vals, c.wts); !close_to(x, c.want) {
+			t.Errorf("%s %v %v: got %v, expected %v", c.est, c.vals, c.wts, x, c.want)
+		}
+		if x := est.Estimate([]float64{}, nil); !math.IsNaN(x) {
+			t.Errorf("%s: got %v for no values, expected NaN", c.est, x)
+		}
+	}
+
+	if _, err := NewEstimator("tmean", conf); err == nil {
+		t.Errorf("expected an error for tmean")
+	}
+}
+
+// The Huber estimate solves sum psi((v - mu) / s) = 0, where psi clips
+// at k and s is the normalized MAD.
+func TestHuber(t *testing.T) {
+
+	conf := &Conf{HuberK: 1.345}
+	est, err := NewEstimator("huber", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, wts := range [][]float64{nil, {1, 2, 1, 1, 0.5}} {
+		v := []float64{1, 2, 3, 4, 100}
+		mu := est.Estimate(v, wts)
+		s := MAD(v, wts)
+
+		score := float64(0)
+		for i, x := range v {
+			w := float64(1)
+			if wts != nil {
+				w = wts[i]
+			}
+			score += w * math.Max(-1.345, math.Min(1.345, (x-mu)/s))
+		}
+		if math.Abs(score) > 1e-6 || mu < 2 || mu > 4 {
+			t.Errorf("weights %v: estimate %v has score %v", wts, mu, score)
+		}
+	}
+}
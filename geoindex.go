@@ -0,0 +1,322 @@
+package indialights
+
+// GeoIndex is a spatial index for points on the Earth's surface.
+// Points are stored as unit vectors in three dimensions and organized
+// into a k-d tree.  The straight line (chord) distance between two
+// unit vectors is an increasing function of their great circle
+// distance, so radius and nearest neighbor queries in three
+// dimensions give exact answers for great circle distances at all
+// latitudes (including near the poles and across the dateline).
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+)
+
+const (
+	// Radius of the Earth in meters
+	EarthRadius = 6378137.0
+
+	// Nodes with no more than this many points are searched
+	// exhaustively
+	leaf_size = 8
+)
+
+// GeoIndex supports radius and nearest neighbor queries on a fixed
+// set of points.
+type GeoIndex struct {
+
+	// The points as unit vectors
+	pts [][3]float64
+
+	// The k-d tree is stored implicitly in perm, with the node
+	// covering perm[lo:hi] split at perm[(lo+hi)/2] along
+	// axis[(lo+hi)/2].
+	perm []int
+	axis []int8
+}
+
+// unit_vector converts latitude/longitude in degrees to a point on
+// the unit sphere.
+func unit_vector(lat, lon float64) [3]float64 {
+	la := lat * math.Pi / 180
+	lo := lon * math.Pi / 180
+	return [3]float64{math.Cos(la) * math.Cos(lo), math.Cos(la) * math.Sin(lo), math.Sin(la)}
+}
+
+// chord_dist converts a great circle distance in meters to a squared
+// chord distance on the unit sphere.
+func chord_dist(d float64) float64 {
+	if d >= math.Pi*EarthRadius {
+		return 4
+	}
+	c := 2 * math.Sin(d/(2*EarthRadius))
+	return c * c
+}
+
+// geo_dist converts a squared chord distance on the unit sphere to a
+// great circle distance in meters.
+func geo_dist(c2 float64) float64 {
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(c2)/2))
+}
+
+func sqdist(a, b [3]float64) float64 {
+	u := a[0] - b[0]
+	v := a[1] - b[1]
+	w := a[2] - b[2]
+	return u*u + v*v + w*w
+}
+
+// GeoDistance returns the great circle distance in meters between two
+// points given by latitude and longitude in degrees.
+func GeoDistance(lat1, lon1, lat2, lon2 float64) float64 {
+	return geo_dist(sqdist(unit_vector(lat1, lon1), unit_vector(lat2, lon2)))
+}
+
+// NewGeoIndex returns an index of the points with the given
+// latitudes and longitudes (in degrees).  Query results refer to
+// points by their position in lat/lon.
+func NewGeoIndex(lat, lon []float64) *GeoIndex {
+
+	g := &GeoIndex{
+		pts:  make([][3]float64, len(lat)),
+		perm: make([]int, len(lat)),
+		axis: make([]int8, len(lat)),
+	}
+	for i := range lat {
+		g.pts[i] = unit_vector(lat[i], lon[i])
+		g.perm[i] = i
+	}
+	g.build(0, len(lat))
+
+	return g
+}
+
+func (g *GeoIndex) build(lo, hi int) {
+
+	if hi-lo <= leaf_size {
+		return
+	}
+
+	// Split along the axis with the greatest spread
+	var mn, mx [3]float64
+	for j := 0; j < 3; j++ {
+		mn[j] = math.Inf(1)
+		mx[j] = math.Inf(-1)
+	}
+	for _, i := range g.perm[lo:hi] {
+		for j := 0; j < 3; j++ {
+			mn[j] = math.Min(mn[j], g.pts[i][j])
+			mx[j] = math.Max(mx[j], g.pts[i][j])
+		}
+	}
+	ax := 0
+	for j := 1; j < 3; j++ {
+		if mx[j]-mn[j] > mx[ax]-mn[ax] {
+			ax = j
+		}
+	}
+
+	p := g.perm[lo:hi]
+	sort.Slice(p, func(i, j int) bool {
+		if g.pts[p[i]][ax] != g.pts[p[j]][ax] {
+			return g.pts[p[i]][ax] < g.pts[p[j]][ax]
+		}
+		return p[i] < p[j]
+	})
+
+	mid := (lo + hi) / 2
+	g.axis[mid] = int8(ax)
+	g.build(lo, mid)
+	g.build(mid+1, hi)
+}
+
+// Within returns the points that are within d meters of (lat, lon),
+// along with their distances in meters, in order of increasing
+// distance (ties are broken by position).
+func (g *GeoIndex) Within(lat, lon, d float64) ([]int, []float64) {
+
+	q := unit_vector(lat, lon)
+	c2 := chord_dist(d)
+	c := math.Sqrt(c2)
+
+	var ix []int
+	var dd []float64
+	var search func(lo, hi int)
+	search = func(lo, hi int) {
+		if hi-lo <= leaf_size {
+			for _, i := range g.perm[lo:hi] {
+				if e := sqdist(q, g.pts[i]); e <= c2 {
+					ix = append(ix, i)
+					dd = append(dd, e)
+				}
+			}
+			return
+		}
+		mid := (lo + hi) / 2
+		i := g.perm[mid]
+		if e := sqdist(q, g.pts[i]); e <= c2 {
+			ix = append(ix, i)
+			dd = append(dd, e)
+		}
+		diff := q[g.axis[mid]] - g.pts[i][g.axis[mid]]
+		if diff <= c {
+			search(lo, mid)
+		}
+		if diff >= -c {
+			search(mid+1, hi)
+		}
+	}
+	search(0, len(g.perm))
+
+	return sorted_result(ix, dd)
+}
+
+// A max-heap of candidate neighbors, ordered by squared chord
+// distance
+type nbr_heap struct {
+	ix []int
+	dd []float64
+}
+
+func (h *nbr_heap) Len() int { return len(h.ix) }
+func (h *nbr_heap) Less(i, j int) bool {
+	if h.dd[i] != h.dd[j] {
+		return h.dd[i] > h.dd[j]
+	}
+	return h.ix[i] > h.ix[j]
+}
+func (h *nbr_heap) Swap(i, j int) {
+	h.ix[i], h.ix[j] = h.ix[j], h.ix[i]
+	h.dd[i], h.dd[j] = h.dd[j], h.dd[i]
+}
+func (h *nbr_heap) Push(x interface{}) {
+	v := x.(nbr)
+	h.ix = append(h.ix, v.i)
+	h.dd = append(h.dd, v.d)
+}
+func (h *nbr_heap) Pop() interface{} {
+	n := len(h.ix) - 1
+	v := nbr{h.ix[n], h.dd[n]}
+	h.ix = h.ix[0:n]
+	h.dd = h.dd[0:n]
+	return v
+}
+
+type nbr struct {
+	i int
+	d float64
+}
+
+// Nearest returns the k points nearest to (lat, lon), along with
+// their distances in meters, in order of increasing distance (ties
+// are broken by position).  If maxdist is positive, only points
+// within maxdist meters are returned, so fewer than k points may be
+// returned.  If keep is not nil, only the points for which keep
+// returns true are considered.
+func (g *GeoIndex) Nearest(lat, lon float64, k int, maxdist float64, keep func(int) bool) ([]int, []float64) {
+
+	if k <= 0 {
+		return nil, nil
+	}
+
+	q := unit_vector(lat, lon)
+	bound := math.Inf(1)
+	if maxdist > 0 {
+		bound = chord_dist(maxdist)
+	}
+
+	h := &nbr_heap{}
+
+	// Consider adding point i to the heap
+	consider := func(i int) {
+		e := sqdist(q, g.pts[i])
+		if e > bound || (keep != nil && !keep(i)) {
+			return
+		}
+		if h.Len() < k {
+			heap.Push(h, nbr{i, e})
+		} else if e < h.dd[0] || (e == h.dd[0] && i < h.ix[0]) {
+			h.ix[0] = i
+			h.dd[0] = e
+			heap.Fix(h, 0)
+		} else {
+			return
+		}
+		if h.Len() == k && h.dd[0] < bound {
+			bound = h.dd[0]
+		}
+	}
+
+	var search func(lo, hi int)
+	search = func(lo, hi int) {
+		if hi-lo <= leaf_size {
+			for _, i := range g.perm[lo:hi] {
+				consider(i)
+			}
+			return
+		}
+		mid := (lo + hi) / 2
+		consider(g.perm[mid])
+		diff := q[g.axis[mid]] - g.pts[g.perm[mid]][g.axis[mid]]
+		if diff <= 0 {
+			search(lo, mid)
+			if diff*diff <= bound {
+				search(mid+1, hi)
+			}
+		} else {
+			search(mid+1, hi)
+			if diff*diff <= bound {
+				search(lo, mid)
+			}
+		}
+	}
+	search(0, len(g.perm))
+
+	return sorted_result(h.ix, h.dd)
+}
+
+// Sort points by distance, breaking ties by position
+type by_chord struct {
+	ix []int
+	dd []float64
+}
+
+func (a by_chord) Len() int { return len(a.ix) }
+func (a by_chord) Less(i, j int) bool {
+	if a.dd[i] != a.dd[j] {
+		return a.dd[i] < a.dd[j]
+	}
+	return a.ix[i] < a.ix[j]
+}
+func (a by_chord) Swap(i, j int) {
+	a.ix[i], a.ix[j] = a.ix[j], a.ix[i]
+	a.dd[i], a.dd[j] = a.dd[j], a.dd[i]
+}
+
+// sorted_result sorts the points by squared chord distance and
+// converts the distances to meters.
+func sorted_result(ix []int, dd []float64) ([]int, []float64) {
+	sort.Sort(by_chord{ix, dd})
+	for j, e := range dd {
+		dd[j] = geo_dist(e)
+	}
+	return ix, dd
+}
+
+// Bearing returns the initial bearing in degrees (clockwise from
+// north, in [0, 360)) of the great circle path from (lat1, lon1) to
+// (lat2, lon2).
+func Bearing(lat1, lon1, lat2, lon2 float64) float64 {
+
+	la1 := lat1 * math.Pi / 180
+	la2 := lat2 * math.Pi / 180
+	dl := (lon2 - lon1) * math.Pi / 180
+
+	y := math.Sin(dl) * math.Cos(la2)
+	x := math.Cos(la1)*math.Sin(la2) - math.Sin(la1)*math.Cos(la2)*math.Cos(dl)
+	b := math.Atan2(y, x) * 180 / math.Pi
+
+	return math.Mod(b+360, 360)
+}
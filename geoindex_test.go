@@ -0,0 +1,114 @@
+package indialights
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// brute_force returns the points within the squared chord distance
+// c2 of q, ordered as in the index queries.
+func brute_force(pts [][3]float64, q [3]float64, c2 float64) ([]int, []float64) {
+
+	var ix []int
+	var dd []float64
+	for i, p := range pts {
+		if e := sqdist(q, p); e <= c2 {
+			ix = append(ix, i)
+			dd = append(dd, e)
+		}
+	}
+
+	return sorted_result(ix, dd)
+}
+
+// test_points returns random points, including points near the poles
+// and the dateline, and repeated points.
+func test_points(rng *rand.Rand, n int) ([]float64, []float64) {
+
+	lat := make([]float64, n)
+	lon := make([]float64, n)
+	for i := range lat {
+		switch {
+		case i%10 == 0:
+			lat[i] = 89 + rng.Float64()
+			lon[i] = 360*rng.Float64() - 180
+		case i%10 == 1:
+			lat[i] = 20 * (rng.Float64() - 0.5)
+			lon[i] = 179.5 + rng.Float64()
+			if lon[i] > 180 {
+				lon[i] -= 360
+			}
+		case i%10 == 2 && i > 10:
+			lat[i] = lat[i-7]
+			lon[i] = lon[i-7]
+		default:
+			lat[i] = 10 + 20*rng.Float64()
+			lon[i] = 70 + 20*rng.Float64()
+		}
+	}
+
+	return lat, lon
+}
+
+func TestGeoIndex(t *testing.T) {
+
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, 5, 100, 2000} {
+
+		lat, lon := test_points(rng, n)
+		g := NewGeoIndex(lat, lon)
+		qlat, qlon := test_points(rng, 50)
+
+		for j := range qlat {
+			q := unit_vector(qlat[j], qlon[j])
+
+			for _, d := range []float64{0, 1000, 50000, 500000, 3e7} {
+				ix, dd := g.Within(qlat[j], qlon[j], d)
+				ex, _ := brute_force(g.pts, q, chord_dist(d))
+				if len(ix) != len(ex) || (len(ex) > 0 && !reflect.DeepEqual(ix, ex)) {
+					t.Fatalf("Within(%v, %v, %v): got %v, expected %v", qlat[j], qlon[j], d, ix, ex)
+				}
+				if !sort.Float64sAreSorted(dd) {
+					t.Fatalf("Within distances not sorted")
+				}
+			}
+
+			all, _ := brute_force(g.pts, q, 4)
+			for _, k := range []int{1, 3, 20} {
+				for _, maxdist := range []float64{0, 100000} {
+					ix, _ := g.Nearest(qlat[j], qlon[j], k, maxdist, nil)
+					ex := all
+					if maxdist > 0 {
+						ex, _ = brute_force(g.pts, q, chord_dist(maxdist))
+					}
+					if len(ex) > k {
+						ex = ex[0:k]
+					}
+					if len(ix) != len(ex) || (len(ex) > 0 && !reflect.DeepEqual(ix, ex)) {
+						t.Fatalf("Nearest(%v, %v, %d, %v): got %v, expected %v",
+							qlat[j], qlon[j], k, maxdist, ix, ex)
+					}
+
+					// Only the points that satisfy keep
+					keep := func(i int) bool { return i%3 == 1 }
+					ix, _ = g.Nearest(qlat[j], qlon[j], k, maxdist, keep)
+					ex = nil
+					for _, i := range all {
+						if keep(i) && (maxdist <= 0 || sqdist(q, g.pts[i]) <= chord_dist(maxdist)) {
+							ex = append(ex, i)
+						}
+					}
+					if len(ex) > k {
+						ex = ex[0:k]
+					}
+					if len(ix) != len(ex) || (len(ex) > 0 && !reflect.DeepEqual(ix, ex)) {
+						t.Fatalf("Nearest(%v, %v, %d, %v) with keep: got %v, expected %v",
+							qlat[j], qlon[j], k, maxdist, ix, ex)
+					}
+				}
+			}
+		}
+	}
+}
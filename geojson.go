@@ -0,0 +1,249 @@
+package indialights
+
+// Reading polygon layers from GeoJSON files, and locating points
+// within them.
+//
+// A layer is read from a GeoJSON FeatureCollection, Feature, Polygon
+// or MultiPolygon.  Each feature with a Polygon or MultiPolygon
+// geometry becomes one region of the layer, features with other
+// geometry types are ignored.  Coordinates are [longitude, latitude]
+// pairs, as specified by GeoJSON.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+)
+
+const (
+	// Size in degrees of the grid cells used to find candidate
+	// regions for a point
+	grid_size = 0.5
+)
+
+type gj_geometry struct {
+	Type        string
+	Coordinates json.RawMessage
+	Geometries  []gj_geometry
+}
+
+type gj_object struct {
+	Type       string
+	Properties map[string]interface{}
+	Geometry   *gj_geometry
+	Features   []gj_object
+	gj_geometry
+}
+
+// A ring is a closed sequence of [lon, lat] points.  A polygon is an
+// outer ring followed by zero or more holes.
+type ring [][2]float64
+type polygon []ring
+
+// region is one feature of a layer
+type region struct {
+	polys []polygon
+	bbox  [4]float64 // min lon, min lat, max lon, max lat
+	name  string
+}
+
+// PolygonLayer is a collection of polygonal regions.
+type PolygonLayer struct {
+	regions []region
+
+	// Regions whose bounding box intersects each grid cell
+	grid map[[2]int][]int
+}
+
+// ReadPolygonLayer reads a polygon layer from a GeoJSON file.  If
+// name_prop is not empty, the value of that property of each feature
+// is used as the name of the region, otherwise regions are named by
+// their position in the file.
+func ReadPolygonLayer(fname, name_prop string) (*PolygonLayer, error) {
+
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var obj gj_object
+	err = json.Unmarshal(b, &obj)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+
+	var features []gj_object
+	switch obj.Type {
+	case "FeatureCollection":
+		features = obj.Features
+	case "Feature":
+		features = []gj_object{obj}
+	default:
+		// A bare geometry
+		g := obj.gj_geometry
+		g.Type = obj.Type
+		features = []gj_object{{Type: "Feature", Geometry: &g}}
+	}
+
+	layer := &PolygonLayer{grid: make(map[[2]int][]int)}
+	for k, f := range features {
+		if f.Geometry == nil {
+			continue
+		}
+		polys, err := read_polygons(f.Geometry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: feature %d: %v", fname, k, err)
+		}
+		if len(polys) == 0 {
+			continue
+		}
+
+		name := fmt.Sprintf("%d", k)
+		if name_prop != "" {
+			v, ok := f.Properties[name_prop]
+			if !ok {
+				return nil, fmt.Errorf("%s: feature %d has no property %s", fname, k, name_prop)
+			}
+			name = fmt.Sprintf("%v", v)
+		}
+
+		layer.add(region{polys: polys, name: name})
+	}
+
+	return layer, nil
+}
+
+// read_polygons returns the polygons in a geometry, which may be a
+// Polygon, MultiPolygon or GeometryCollection.  Other geometry types
+// contribute no polygons.
+func read_polygons(g *gj_geometry) ([]polygon, error) {
+
+	switch g.Type {
+	case "Polygon":
+		var p polygon
+		err := json.Unmarshal(g.Coordinates, &p)
+		if err != nil {
+			return nil, err
+		}
+		return []polygon{p}, nil
+	case "MultiPolygon":
+		var mp []polygon
+		err := json.Unmarshal(g.Coordinates, &mp)
+		if err != nil {
+			return nil, err
+		}
+		return mp, nil
+	case "GeometryCollection":
+		var polys []polygon
+		for j := range g.Geometries {
+			p, err := read_polygons(&g.Geometries[j])
+			if err != nil {
+				return nil, err
+			}
+			polys = append(polys, p...)
+		}
+		return polys, nil
+	}
+
+	return nil, nil
+}
+
+func grid_cell(lat, lon float64) [2]int {
+	return [2]int{int(math.Floor(lat / grid_size)), int(math.Floor(lon / grid_size))}
+}
+
+func (layer *PolygonLayer) add(r region) {
+
+	r.bbox = [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	for _, p := range r.polys {
+		if len(p) == 0 {
+			continue
+		}
+		for _, pt := range p[0] {
+			r.bbox[0] = math.Min(r.bbox[0], pt[0])
+			r.bbox[1] = math.Min(r.bbox[1], pt[1])
+			r.bbox[2] = math.Max(r.bbox[2], pt[0])
+			r.bbox[3] = math.Max(r.bbox[3], pt[1])
+		}
+	}
+	if r.bbox[0] > r.bbox[2] {
+		return
+	}
+
+	k := len(layer.regions)
+	layer.regions = append(layer.regions, r)
+
+	c1 := grid_cell(r.bbox[1], r.bbox[0])
+	c2 := grid_cell(r.bbox[3], r.bbox[2])
+	for i := c1[0]; i <= c2[0]; i++ {
+		for j := c1[1]; j <= c2[1]; j++ {
+			c := [2]int{i, j}
+			layer.grid[c] = append(layer.grid[c], k)
+		}
+	}
+}
+
+// in_ring uses ray casting to determine whether (lon, lat) is inside
+// a ring.
+func in_ring(rg ring, lon, lat float64) bool {
+
+	in := false
+	n := len(rg)
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		xi, yi := rg[i][0], rg[i][1]
+		xj, yj := rg[j][0], rg[j][1]
+		if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			in = !in
+		}
+	}
+
+	return in
+}
+
+func (r *region) contains(lat, lon float64) bool {
+
+	if lon < r.bbox[0] || lat < r.bbox[1] || lon > r.bbox[2] || lat > r.bbox[3] {
+		return false
+	}
+
+	for _, p := range r.polys {
+		if len(p) == 0 || !in_ring(p[0], lon, lat) {
+			continue
+		}
+		hole := false
+		for _, h := range p[1:] {
+			if in_ring(h, lon, lat) {
+				hole = true
+				break
+			}
+		}
+		if !hole {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Len returns the number of regions in the layer.
+func (layer *PolygonLayer) Len() int {
+	return len(layer.regions)
+}
+
+// Name returns the name of region k.
+func (layer *PolygonLayer) Name(k int) string {
+	return layer.regions[k].name
+}
+
+// Locate returns the position of the first region that contains the
+// point (lat, lon), or -1 if no region contains it.
+func (layer *PolygonLayer) Locate(lat, lon float64) int {
+
+	for _, k := range layer.grid[grid_cell(lat, lon)] {
+		if layer.regions[k].contains(lat, lon) {
+			return k
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,126 @@
+package indialights
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+const test_layer = `{
+  "type": "FeatureCollection",
+  "features": [
+    {"type": "Feature", "properties": {"name": "A"},
+     "geometry": {"type": "Polygon", "coordinates": [
+       [[70, 10], [72, 10], [72, 12], [70, 12], [70, 10]],
+       [[70.5, 10.5], [71.5, 10.5], [71.5, 11.5], [70.5, 11.5], [70.5, 10.5]]]}},
+    {"type": "Feature", "properties": {"name": "B"},
+     "geometry": {"type": "MultiPolygon", "coordinates": [
+       [[[80, 20], [81, 20], [81, 21], [80, 21], [80, 20]]],
+       [[[85, 25], [86, 25], [86, 26], [85, 26], [85, 25]]]]}},
+    {"type": "Feature", "properties": {"name": "C"},
+     "geometry": {"type": "Polygon", "coordinates": [
+       [[74.2, 14.2], [75.8, 14.2], [75.8, 15.8], [74.2, 15.8], [74.2, 14.2]]]}},
+    {"type": "Feature", "properties": {"name": "D"},
+     "geometry": {"type": "LineString", "coordinates": [[60, 5], [61, 6]]}}
+  ]
+}`
+
+func write_layer(t *testing.T, s string) string {
+	fname := filepath.Join(t.TempDir(), "layer.geojson")
+	if err := ioutil.WriteFile(fname, []byte(s), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestLocate(t *testing.T) {
+
+	layer, err := ReadPolygonLayer(write_layer(t, test_layer), "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The LineString feature is not a region
+	if layer.Len() != 3 {
+		t.Fatalf("got %d regions, expected 3", layer.Len())
+	}
+
+	cases := []struct {
+		lat, lon float64
+		name     string
+	}{
+		{10.2, 70.2, "A"},
+
+		// Inside the hole of A
+		{11, 71, ""},
+
+		// Both parts of the MultiPolygon, and between them
+		{20.5, 80.5, "B"},
+		{25.5, 85.5, "B"},
+		{23, 83, ""},
+
+		// On the boundaries of the grid cells, C spans several
+		// cells
+		{15, 75, "C"},
+		{14.5, 74.5, "C"},
+		{15.5, 75.5, "C"},
+
+		// Outside every region
+		{15.9, 75, ""},
+		{0, 0, ""},
+		{-20.5, -80.5, ""},
+		{5.5, 60.5, ""},
+	}
+
+	for _, c := range cases {
+		name := ""
+		if k := layer.Locate(c.lat, c.lon); k != -1 {
+			name = layer.Name(k)
+		}
+		if name != c.name {
+			t.Errorf("(%v, %v): got %q, expected %q", c.lat, c.lon, name, c.name)
+		}
+	}
+}
+
+func TestReadPolygonLayer(t *testing.T) {
+
+	// A bare geometry, regions are named by position
+	bare := `{"type": "Polygon", "coordinates": [[[0, 0], [1, 0], [1, 1], [0, 1], [0, 0]]]}`
+	layer, err := ReadPolygonLayer(write_layer(t, bare), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer.Len() != 1 || layer.Name(0) != "0" || layer.Locate(0.5, 0.5) != 0 {
+		t.Errorf("bare polygon not read correctly")
+	}
+
+	if _, err := ReadPolygonLayer(write_layer(t, test_layer), "code"); err == nil {
+		t.Errorf("expected an error for a missing name property")
+	}
+	if _, err := ReadPolygonLayer(write_layer(t, "{"), ""); err == nil {
+		t.Errorf("expected an error for invalid json")
+	}
+}
+
+func TestInRing(t *testing.T) {
+
+	// A triangle, in [lon, lat] order
+	rg := ring{{0, 0}, {4, 0}, {0, 4}, {0, 0}}
+	cases := []struct {
+		lon, lat float64
+		in       bool
+	}{
+		{1, 1, true},
+		{1.9, 1.9, true},
+		{2.1, 2.1, false},
+		{-1, 1, false},
+		{1, -1, false},
+		{5, 5, false},
+	}
+	for _, c := range cases {
+		if in_ring(rg, c.lon, c.lat) != c.in {
+			t.Errorf("(%v, %v): expected %v", c.lon, c.lat, c.in)
+		}
+	}
+}
@@ -3,11 +3,17 @@ package indialights
 import (
 	"bufio"
 	"compress/gzip"
+	"encoding/gob"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Conf struct {
@@ -29,6 +35,21 @@ type Conf struct {
 	// Column of longitude value in raw DS file
 	DSLonCol int
 
+	// How darkspots are identified: "coords" (the default) uses
+	// the coordinates rounded to DSKeyPrecision decimal places, "id"
+	// uses the values in DSIdCol and DSLatLonIdCol
+	DSKeyMode string
+
+	// Number of decimal places of the coordinates used in darkspot
+	// keys (default 8)
+	DSKeyPrecision int
+
+	// Column of darkspot id in raw DS file ("id" DSKeyMode)
+	DSIdCol int
+
+	// Column of darkspot id in DSLatLonFile ("id" DSKeyMode)
+	DSLatLonIdCol int
+
 	// Village data raw file
 	ViRawFile string
 
@@ -50,9 +71,23 @@ type Conf struct {
 	// Column in MatchRawFile containing darkspot id
 	MatchDSIdCol int
 
+	// Column in MatchRawFile containing the village to darkspot
+	// distance in meters (0 if there is no distance column)
+	MatchDistCol int
+
 	// Dark spot to village matches
 	MatchGobFile string
 
+	// Distances corresponding to the matches in MatchGobFile
+	MatchDistFile string
+
+	// If set, reindex writes the matches and distances to this
+	// binary CSR file (see WriteMatchCSR) instead of MatchGobFile
+	// and MatchDistFile, and the matches are read from it.  The
+	// darkspot indices are checked against DSIndexFile when the
+	// file is opened.
+	MatchCSRFile string
+
 	// Place to store the dark spot id's in order
 	DSIndexFile string
 
@@ -77,28 +112,223 @@ type Conf struct {
 	// Number of villages per chunk
 	ChunkSize int
 
+	// Number of darkspots per chunk (defaults to ChunkSize).  The
+	// darkspot chunks for a date are always read together.
+	DSChunkSize int
+
+	// Columns in which the fraction of non-missing values is below
+	// SparseDensity are written in sparse form (0 disables this)
+	SparseDensity float64
+
 	// Maximum number of darkspots matched to one village
 	MaxMatch int
 
+	// How darkspots are selected when more than MaxMatch are
+	// available: "nearest" (the default), "random" or "bearing"
+	MaxMatchPolicy string
+
+	// Seed for the "random" MaxMatchPolicy
+	MatchSeed int64
+
+	// Number of bearing sectors for the "bearing" MaxMatchPolicy
+	MatchSectors int
+
 	// Lower quantile point for matching, e.g. 0.25 for 25th percentile
 	MatchLower float64
 
 	// Upper quantile point for matching, e.g. 0.75 for 75th percentile
 	MatchUpper float64
 
-	// Initial matching identifies stations within +/- LatTol
-	// degrees latitude
-	LatTol float64
-
-	// Initial matching identifies stations within +/- LonTol
-	// degrees longitude
-	LonTol float64
-
 	// Darkspot matches must be within this geodesic distance of
 	// this geodesic distance of the target village
 	MTol float64
+
+	// Darkspots closer than this geodesic distance to the target
+	// village are excluded from its matches
+	MinDist float64
+
+	// Matching mode, either "radius" (the default) to use all
+	// darkspots within MTol, or "knn" to use the MatchK darkspots
+	// nearest to each village (restricted to MTol if MTol is
+	// positive).  "box" is no longer supported, the LatTol/LonTol
+	// box was replaced by MTol.
+	MatchMode string
+
+	// Number of darkspots matched to each village in "knn" mode
+	MatchK int
+
+	// Restrict the darkspots matched to each village to those in
+	// the same "state", "district", or "polygon" of BoundaryFile
+	// ("" for no restriction)
+	MatchConstraint string
+
+	// Column in DSLatLonFile containing the darkspot state code,
+	// required for the "state" and "district" constraints (columns
+	// 0 and 1 are the coordinates)
+	DSStateCol int
+
+	// Column in DSLatLonFile containing the darkspot district code,
+	// required for the "district" constraint
+	DSDistCol int
+
+	// GeoJSON file of polygons for the "polygon" matching
+	// constraint
+	BoundaryFile string
+
+	// If fewer darkspots than this satisfy the matching constraint,
+	// the constraint is relaxed (from district to state, then to no
+	// constraint)
+	MinConstrainedMatch int
+
+	// GeoJSON files (in Path) of polygons marking areas where
+	// darkspots should not be used, e.g. water bodies or areas with
+	// fires or gas flares
+	ExclusionFiles []string
+
+	// Gzipped csv files (with header rows) of darkspot and village
+	// covariates.  The darkspot file has the same key columns as
+	// DSLatLonFile, the village file has the village id in the first
+	// column.
+	DSCovFile string
+	ViCovFile string
+
+	// Names of the covariates used for covariate matching
+	CovNames []string
+
+	// Distance between standardized covariates, "euclidean" (the
+	// default) or "mahalanobis"
+	CovDistance string
+
+	// Number of geographically matched darkspots kept for each
+	// village, ranked by covariate distance
+	CovK int
+
+	// Villages with fewer matches than this are listed in the match
+	// report
+	ReportMinMatch int
+
+	// Number of workers used for matching (defaults to the number
+	// of CPUs)
+	MatchWorkers int
+
+	// Vis value above which a darkspot is considered to be lit on
+	// a night, used by screen_darkspots
+	ScreenThreshold float64
+
+	// Darkspots are blacklisted if their long-run mean vis value
+	// exceeds ScreenMaxMean, if the fraction of nights on which they
+	// are lit exceeds ScreenMaxLitFrac, or if their trend in vis
+	// (per year) exceeds ScreenMaxTrend.  A value of 0 disables
+	// the corresponding criterion.
+	ScreenMaxMean    float64
+	ScreenMaxLitFrac float64
+	ScreenMaxTrend   float64
+
+	// Minimum number of observed values for a darkspot to be
+	// screened
+	ScreenMinObs int
+
+	// Csv file of blacklisted darkspots written by
+	// screen_darkspots, background ignores these darkspots if this
+	// is set
+	DSBlacklistFile string
+
+	// Length of the periods over which the darkspot match sets may
+	// vary, "" (the match sets do not vary), "year" or "month"
+	MatchPeriod string
+
+	// Darkspots whose mean vis value within a period exceeds this
+	// are excluded from all match sets in that period
+	PeriodThreshold float64
+
+	// Minimum number of observed values within a period for a
+	// darkspot to be excluded in that period
+	PeriodMinObs int
+
+	// Kernel used to weight darkspots by their distance from the
+	// village when calculating the background, one of "" (no
+	// weighting), "inverse", "gaussian" or "tricube"
+	BgKernel string
+
+	// Bandwidth of the distance kernel, in meters
+	BgBandwidth float64
+
+	// Darkspot values from all dates within this many days of a
+	// date are pooled to calculate its background (0 for no
+	// pooling)
+	BgPoolDays int
+
+	// Weighting of the pooled dates by their distance in days d
+	// from the date, "" (equal weights) or "triangular" (weight
+	// 1 - d / (BgPoolDays + 1))
+	BgPoolWeight string
+
+	// The background is set to NaN for villages with fewer than
+	// BgMinValid valid darkspot values, or fewer than
+	// BgMinValidFrac times the number of matched darkspots (0 to
+	// disable either rule)
+	BgMinValid     int
+	BgMinValidFrac float64
+
+	// If true, background also writes robust scale statistics
+	// (MAD, IQR and quantiles) of the darkspot values
+	BgRobustScale bool
+
+	// Number of bootstrap resamples used to calculate standard
+	// errors and confidence intervals for the background (0 for
+	// none)
+	BgBootstrap int
+
+	// Seed for the bootstrap resampling
+	BgBootSeed int64
+
+	// Coverage of the bootstrap confidence intervals, e.g. 0.95
+	BgBootLevel float64
+
+	// Additional background estimators, any of "median", "winsor",
+	// "huber" and "quantile".  Each is written to its own
+	// variable (e.g. bg_median_##.gz) alongside background.
+	BgEstimators []string
+
+	// Quantile point for the "quantile" background estimator
+	BgQuantile float64
+
+	// Tuning constant for the "huber" background estimator, in
+	// units of the normalized MAD (default 1.345)
+	HuberK float64
+
+	// Approximate memory budget in megabytes for the chunks of
+	// villages that background processes at once (0 for the
+	// default of 40 chunks at once)
+	BgMemory float64
+
+	// On each date, background drops the darkspot values above
+	// OutlierMax, and the values more than OutlierSD standard
+	// deviations above the darkspot's long-run mean (as calculated
+	// by screen_darkspots, for darkspots with at least ScreenMinObs
+	// observed values).  A value of 0 disables the corresponding
+	// rule.
+	OutlierMax float64
+	OutlierSD  float64
 }
 
+// Reasons that the background value of a village is missing, stored
+// in the bgflag variable written by background
+const (
+	// The background is valid
+	BgOK = 0
+
+	// There are no valid darkspot values
+	BgNoValid = 1
+
+	// There are fewer than Conf.BgMinValid valid darkspot values
+	BgFewValid = 2
+
+	// There are fewer than Conf.BgMinValidFrac times the number of
+	// matched darkspots valid darkspot values
+	BgFewValidFrac = 3
+)
+
 type Info struct {
 	Nvillage int
 	Nchunk   int
@@ -196,3 +426,373 @@ func ReadIdx(fname string) map[string]int64 {
 
 	return idx
 }
+
+// ReadMatches reads the village to darkspot matches written by
+// reindex.  match[i] contains the darkspot indices matched to village
+// i.
+func ReadMatches(fname string) [][]int64 {
+	var match [][]int64
+	read_gob(fname, &match)
+	return match
+}
+
+// ReadMatchDists reads the village to darkspot distances written by
+// reindex.  dist[i][j] is the distance in meters between village i
+// and darkspot match[i][j].
+func ReadMatchDists(fname string) [][]float64 {
+	var dist [][]float64
+	read_gob(fname, &dist)
+	return dist
+}
+
+// GetMatches returns the matches written by reindex, read from
+// conf.MatchCSRFile if it is set and otherwise from conf.MatchGobFile.
+func GetMatches(conf *Conf) [][]int64 {
+
+	if conf.MatchCSRFile == "" {
+		return ReadMatches(path.Join(conf.Path, conf.MatchGobFile))
+	}
+
+	mc, err := OpenMatchCSR(path.Join(conf.Path, conf.MatchCSRFile), num_darkspots(conf))
+	if err != nil {
+		panic(err)
+	}
+	return mc.Rows()
+}
+
+// GetMatchDists returns the match distances written by reindex, read
+// from conf.MatchCSRFile if it is set and otherwise from
+// conf.MatchDistFile.
+func GetMatchDists(conf *Conf) [][]float64 {
+
+	if conf.MatchCSRFile == "" {
+		return ReadMatchDists(path.Join(conf.Path, conf.MatchDistFile))
+	}
+
+	fname := path.Join(conf.Path, conf.MatchCSRFile)
+	mc, err := OpenMatchCSR(fname, num_darkspots(conf))
+	if err != nil {
+		panic(err)
+	}
+	if mc.Dist == nil {
+		panic(fmt.Sprintf("%s does not contain distances", fname))
+	}
+	return mc.RowDists()
+}
+
+// num_darkspots returns the number of darkspots in conf.DSIndexFile.
+func num_darkspots(conf *Conf) int {
+	return len(ReadIdx(path.Join(conf.Path, conf.DSIndexFile)))
+}
+
+func read_gob(fname string, x interface{}) {
+	fid, err := os.Open(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	rdr, err := gzip.NewReader(fid)
+	if err != nil {
+		panic(err)
+	}
+	defer rdr.Close()
+	dec := gob.NewDecoder(rdr)
+	err = dec.Decode(x)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// CoordKey returns the canonical key of a darkspot located at (lat,
+// lon), with the coordinates rounded to prec decimal places.
+func CoordKey(lat, lon float64, prec int) string {
+
+	round := func(x float64) string {
+		s := math.Pow(10, float64(prec))
+		x = math.Round(x*s) / s
+		if x == 0 {
+			// Avoid "-0.0"
+			x = 0
+		}
+		return strconv.FormatFloat(x, 'f', prec, 64)
+	}
+
+	return round(lat) + ":" + round(lon)
+}
+
+// DarkspotKey returns the canonical key of the darkspot in a csv
+// record.  If conf.DSKeyMode is "id", the key is the value in column
+// id_col, otherwise it is the CoordKey of the values in columns
+// lat_col and lon_col.
+func DarkspotKey(conf *Conf, fields []string, lat_col, lon_col, id_col int) (string, error) {
+
+	switch conf.DSKeyMode {
+	case "id":
+		if id_col >= len(fields) {
+			return "", fmt.Errorf("missing darkspot id column")
+		}
+		return strings.TrimSpace(fields[id_col]), nil
+	case "", "coords":
+		if lat_col >= len(fields) || lon_col >= len(fields) {
+			return "", fmt.Errorf("missing darkspot coordinate columns")
+		}
+		lat, err := strconv.ParseFloat(strings.TrimSpace(fields[lat_col]), 64)
+		if err != nil {
+			return "", err
+		}
+		lon, err := strconv.ParseFloat(strings.TrimSpace(fields[lon_col]), 64)
+		if err != nil {
+			return "", err
+		}
+		prec := conf.DSKeyPrecision
+		if prec <= 0 {
+			prec = 8
+		}
+		return CoordKey(lat, lon, prec), nil
+	default:
+		return "", fmt.Errorf("unknown DSKeyMode %s", conf.DSKeyMode)
+	}
+}
+
+// ReadDarkspots reads the darkspot keys and coordinates from
+// conf.DSLatLonFile, in which the first two columns are the latitude
+// and longitude.  It panics if two rows have the same key, since
+// they would be treated as one darkspot.
+func ReadDarkspots(conf *Conf) ([]string, []float64, []float64) {
+
+	fid, err := os.Open(filepath.Join(conf.Path, conf.DSLatLonFile))
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	rdr, err := gzip.NewReader(fid)
+	if err != nil {
+		panic(err)
+	}
+	defer rdr.Close()
+
+	var keys []string
+	var lat, lon []float64
+	line := make(map[string]int)
+	scanner := bufio.NewScanner(rdr)
+	for ln := 1; scanner.Scan(); ln++ {
+		fields := strings.Split(scanner.Text(), ",")
+		key, err := DarkspotKey(conf, fields, 0, 1, conf.DSLatLonIdCol)
+		if err != nil {
+			panic(err)
+		}
+		if l, ok := line[key]; ok {
+			panic(fmt.Sprintf("%s: lines %d and %d have the same darkspot key %s",
+				conf.DSLatLonFile, l, ln, key))
+		}
+		line[key] = ln
+		la, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			panic(err)
+		}
+		lo, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			panic(err)
+		}
+		keys = append(keys, key)
+		lat = append(lat, la)
+		lon = append(lon, lo)
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	return keys, lat, lon
+}
+
+// ReadVillages reads the village ids and coordinates from
+// conf.ViInfoFile, in which columns 3, 4 and 5 are the village id,
+// latitude and longitude.
+func ReadVillages(conf *Conf) ([]string, []float64, []float64) {
+
+	fid, err := os.Open(filepath.Join(conf.Path, conf.ViInfoFile))
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	rdr, err := gzip.NewReader(fid)
+	if err != nil {
+		panic(err)
+	}
+	defer rdr.Close()
+
+	var ids []string
+	var lat, lon []float64
+	scanner := bufio.NewScanner(rdr)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		la, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil {
+			panic(err)
+		}
+		lo, err := strconv.ParseFloat(fields[5], 64)
+		if err != nil {
+			panic(err)
+		}
+		ids = append(ids, fields[3])
+		lat = append(lat, la)
+		lon = append(lon, lo)
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	return ids, lat, lon
+}
+
+// DatePeriod returns the period ("year" or "month") containing the
+// date of a date directory .../year/month/day.
+func DatePeriod(dir, period string) string {
+
+	v := strings.Split(filepath.Clean(dir), string(filepath.Separator))
+	m := len(v)
+	if m < 3 {
+		panic(fmt.Sprintf("%s is not a date directory", dir))
+	}
+
+	switch period {
+	case "year":
+		return v[m-3]
+	case "month":
+		return v[m-3] + "-" + v[m-2]
+	default:
+		panic(fmt.Sprintf("unknown period %s", period))
+	}
+}
+
+// ReadPeriodExclusions reads the darkspots that are excluded in each
+// period, as written by period_screen.  excl[p] contains the indices
+// of the darkspots excluded during period p.
+func ReadPeriodExclusions(fname string) map[string][]int64 {
+	var excl map[string][]int64
+	read_gob(fname, &excl)
+	return excl
+}
+
+// DirDate returns the date of a date directory .../year/month/day.
+func DirDate(dir string) time.Time {
+
+	v := strings.Split(filepath.Clean(dir), string(filepath.Separator))
+	m := len(v)
+	if m < 3 {
+		panic(fmt.Sprintf("%s is not a date directory", dir))
+	}
+
+	var ymd [3]int
+	for j := range ymd {
+		x, err := strconv.Atoi(v[m-3+j])
+		if err != nil {
+			panic(fmt.Sprintf("%s is not a date directory", dir))
+		}
+		ymd[j] = x
+	}
+
+	return time.Date(ymd[0], time.Month(ymd[1]), ymd[2], 0, 0, 0, 0, time.UTC)
+}
+
+// ReadBlacklist reads the darkspot indices from the first column of
+// a blacklist file written by screen_darkspots.  The file has a
+// header row, and may be edited by hand to add or remove darkspots.
+func ReadBlacklist(fname string) []int64 {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	var idx []int64
+	scanner := bufio.NewScanner(fid)
+	for ln := 0; scanner.Scan(); ln++ {
+		line := strings.TrimSpace(scanner.Text())
+		if ln == 0 || line == "" {
+			continue
+		}
+		x, err := strconv.ParseInt(strings.Split(line, ",")[0], 10, 64)
+		if err != nil {
+			panic(fmt.Sprintf("%s line %d: %v", fname, ln+1, err))
+		}
+		idx = append(idx, x)
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	return idx
+}
+
+// DarkspotScreen contains the long-run statistics for each darkspot
+// calculated by screen_darkspots, in darkspot index order.
+type DarkspotScreen struct {
+	Nobs []float64
+	Mean []float64
+	SD   []float64
+}
+
+// ReadDarkspotScreen reads the darkspot statistics written by
+// screen_darkspots to darkspot_screen.csv.gz.  Darkspots not in the
+// file have zero observations.
+func ReadDarkspotScreen(fname string) *DarkspotScreen {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	rdr, err := gzip.NewReader(fid)
+	if err != nil {
+		panic(err)
+	}
+	defer rdr.Close()
+
+	// Positions of the columns that are used
+	names := []string{"index", "nobs", "mean", "sd"}
+	pos := make([]int, len(names))
+
+	ds := new(DarkspotScreen)
+	scanner := bufio.NewScanner(rdr)
+	for ln := 0; scanner.Scan(); ln++ {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ",")
+
+		if ln == 0 {
+			for j, na := range names {
+				pos[j] = -1
+				for k, f := range fields {
+					if f == na {
+						pos[j] = k
+					}
+				}
+				if pos[j] == -1 {
+					panic(fmt.Sprintf("%s: no %s column", fname, na))
+				}
+			}
+			continue
+		}
+
+		var x [4]float64
+		for j := range x {
+			x[j], err = strconv.ParseFloat(fields[pos[j]], 64)
+			if err != nil {
+				panic(fmt.Sprintf("%s line %d: %v", fname, ln+1, err))
+			}
+		}
+
+		i := int(x[0])
+		for len(ds.Nobs) <= i {
+			ds.Nobs = append(ds.Nobs, 0)
+			ds.Mean = append(ds.Mean, math.NaN())
+			ds.SD = append(ds.SD, math.NaN())
+		}
+		ds.Nobs[i], ds.Mean[i], ds.SD[i] = x[1], x[2], x[3]
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	return ds
+}
@@ -0,0 +1,132 @@
+package indialights
+
+// Ranking of the darkspot values on one date.
+//
+// Most villages share most of their matched darkspots, so rather than
+// sorting the values in each village's match set, the values for all
+// darkspots are sorted once per date.  The sorted values for a match
+// set are then obtained by marking the ranks of its darkspots and
+// scanning the marks in rank order.  This gives exactly the same
+// values, in the same order, as sorting the match set.
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// DarkspotRanks holds the darkspot values for one date in sorted
+// order, and the rank of each darkspot.
+type DarkspotRanks struct {
+
+	// The non-NaN values in increasing order
+	sorted []float64
+
+	// The position of each darkspot's value in sorted, or -1 if the
+	// value is NaN
+	rank []int32
+}
+
+// NewDarkspotRanks ranks the darkspot values dvec for one date.
+func NewDarkspotRanks(dvec []float64) *DarkspotRanks {
+
+	pos := make([]int32, 0, len(dvec))
+	for i, v := range dvec {
+		if !math.IsNaN(v) {
+			pos = append(pos, int32(i))
+		}
+	}
+	sort.Slice(pos, func(i, j int) bool { return dvec[pos[i]] < dvec[pos[j]] })
+
+	r := &DarkspotRanks{
+		sorted: make([]float64, len(pos)),
+		rank:   make([]int32, len(dvec)),
+	}
+	for i := range r.rank {
+		r.rank[i] = -1
+	}
+	for k, i := range pos {
+		r.sorted[k] = dvec[i]
+		r.rank[i] = int32(k)
+	}
+
+	return r
+}
+
+// Len returns the number of non-NaN darkspot values.
+func (r *DarkspotRanks) Len() int {
+	return len(r.sorted)
+}
+
+// SortedValues returns the non-NaN values of the darkspots ix in
+// increasing order.  buf must have length at least len(ix), and mark
+// must have length at least r.Len() and be all false (it is left all
+// false).  A darkspot that is repeated in ix contributes its value
+// once for each repeat, as when sorting the values.  When the match
+// set is small relative to the range of its ranks, or contains
+// repeats, the values are sorted directly instead.
+func (r *DarkspotRanks) SortedValues(ix []int64, buf []float64, mark []bool) []float64 {
+
+	lo, hi := int32(len(r.sorted)), int32(-1)
+	for _, i := range ix {
+		if k := r.rank[i]; k >= 0 {
+			if k < lo {
+				lo = k
+			}
+			if k > hi {
+				hi = k
+			}
+		}
+	}
+	if hi < lo {
+		return buf[0:0]
+	}
+
+	// Scanning costs hi - lo, sorting costs about m log m
+	m := len(ix)
+	if int(hi-lo) > m*bits.Len(uint(m)) {
+		return r.sort_values(ix, buf)
+	}
+
+	for j, i := range ix {
+		if k := r.rank[i]; k >= 0 {
+			if mark[k] {
+				// A repeated darkspot, clear the marks
+				for _, i := range ix[0:j] {
+					if k := r.rank[i]; k >= 0 {
+						mark[k] = false
+					}
+				}
+				return r.sort_values(ix, buf)
+			}
+			mark[k] = true
+		}
+	}
+	ii := 0
+	for k := lo; k <= hi; k++ {
+		if mark[k] {
+			buf[ii] = r.sorted[k]
+			ii++
+			mark[k] = false
+		}
+	}
+
+	return buf[0:ii]
+}
+
+// sort_values returns the non-NaN values of the darkspots ix in
+// increasing order, by sorting them.
+func (r *DarkspotRanks) sort_values(ix []int64, buf []float64) []float64 {
+
+	ii := 0
+	for _, i := range ix {
+		if k := r.rank[i]; k >= 0 {
+			buf[ii] = r.sorted[k]
+			ii++
+		}
+	}
+	vals := buf[0:ii]
+	sort.Float64s(vals)
+
+	return vals
+}
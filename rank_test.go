@@ -0,0 +1,140 @@
+package indialights
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// random_darkspots returns n darkspot values, about 10% of which are
+// NaN, with many ties.
+func random_darkspots(rng *rand.Rand, n int) []float64 {
+	dvec := make([]float64, n)
+	for i := range dvec {
+		if rng.Float64() < 0.1 {
+			dvec[i] = math.NaN()
+		} else {
+			dvec[i] = math.Floor(100*rng.ExpFloat64()) / 100
+		}
+	}
+	return dvec
+}
+
+// random_match returns a match set of m darkspots out of n, with a
+// repeated darkspot if repeat is true.
+func random_match(rng *rand.Rand, n, m int, repeat bool) []int64 {
+	ix := make([]int64, m)
+	for k, i := range rng.Perm(n)[0:m] {
+		ix[k] = int64(i)
+	}
+	if repeat && m > 1 {
+		ix[rng.Intn(m)] = ix[rng.Intn(m)]
+	}
+	return ix
+}
+
+func TestSortedValues(t *testing.T) {
+
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, 10, 200, 2000} {
+		dvec := random_darkspots(rng, n)
+		r := NewDarkspotRanks(dvec)
+		mark := make([]bool, r.Len())
+		buf := make([]float64, n+1)
+		buf2 := make([]float64, n+1)
+
+		// Small match sets use the sort fallback, large match sets
+		// are scanned
+		for _, m := range []int{1, 2, 5, n / 10, n / 2, n} {
+			if m < 1 || m > n {
+				continue
+			}
+			for rep := 0; rep < 50; rep++ {
+				ix := random_match(rng, n, m, rep%2 == 1)
+
+				vals := r.SortedValues(ix, buf, mark)
+				expected := r.sort_values(ix, buf2)
+				if len(vals) != len(expected) || (len(vals) > 0 && !reflect.DeepEqual(vals, expected)) {
+					t.Fatalf("n=%d, ix=%v: got %v, expected %v", n, ix, vals, expected)
+				}
+
+				// The values are the non-NaN values of the darkspots,
+				// sorted
+				var direct []float64
+				for _, i := range ix {
+					if !math.IsNaN(dvec[i]) {
+						direct = append(direct, dvec[i])
+					}
+				}
+				sort.Float64s(direct)
+				if len(vals) != len(direct) || (len(vals) > 0 && !reflect.DeepEqual(vals, direct)) {
+					t.Fatalf("n=%d, ix=%v: got %v, expected %v", n, ix, vals, direct)
+				}
+
+				for k, b := range mark {
+					if b {
+						t.Fatalf("mark %d not cleared", k)
+					}
+				}
+			}
+		}
+	}
+
+	// All values NaN
+	r := NewDarkspotRanks([]float64{math.NaN(), math.NaN()})
+	if vals := r.SortedValues([]int64{0, 1, 1}, make([]float64, 3), nil); len(vals) != 0 {
+		t.Fatalf("got %v, expected no values", vals)
+	}
+}
+
+// benchmark_match returns a synthetic date of darkspot values and
+// match sets, in which each of nvi villages is matched to nmatch of
+// nds darkspots.
+func benchmark_match(nds, nvi, nmatch int) ([]float64, [][]int64) {
+	rng := rand.New(rand.NewSource(1))
+	dvec := random_darkspots(rng, nds)
+	match := make([][]int64, nvi)
+	for vi := range match {
+		match[vi] = random_match(rng, nds, nmatch, vi%100 == 0)
+	}
+	return dvec, match
+}
+
+// BenchmarkSortedValues ranks the darkspots once and obtains the
+// sorted values for each match set, as background does.
+func BenchmarkSortedValues(b *testing.B) {
+
+	dvec, match := benchmark_match(10000, 200, 8000)
+	buf := make([]float64, 8000)
+	b.ResetTimer()
+	for it := 0; it < b.N; it++ {
+		r := NewDarkspotRanks(dvec)
+		mark := make([]bool, r.Len())
+		for _, ix := range match {
+			r.SortedValues(ix, buf, mark)
+		}
+	}
+}
+
+// BenchmarkSortValues sorts the values of each match set, for
+// comparison with BenchmarkSortedValues.
+func BenchmarkSortValues(b *testing.B) {
+
+	dvec, match := benchmark_match(10000, 200, 8000)
+	buf := make([]float64, 8000)
+	b.ResetTimer()
+	for it := 0; it < b.N; it++ {
+		for _, ix := range match {
+			ii := 0
+			for _, i := range ix {
+				if !math.IsNaN(dvec[i]) {
+					buf[ii] = dvec[i]
+					ii++
+				}
+			}
+			sort.Float64s(buf[0:ii])
+		}
+	}
+}
@@ -8,42 +8,139 @@ package main
 // files are also created in each directory: "nvalid.gz" is the sample
 // size for each trimmed mean calculation, and "bsd.gz" is the trimmed
 // standard deviation, based on the same data used to calculate the
-// trimmed mean.
+// trimmed mean.  Chunks with few non-missing values are written in
+// sparse form (see conf.SparseDensity).
+//
+// If conf.BgKernel is set, each darkspot is weighted by a kernel
+// function of its distance from the village, and the trimming points
+// are weighted quantiles.  The weighted trimmed mean and standard
+// deviation then give weight w * f to each darkspot, where w is its
+// kernel weight and f is the fraction of w lying between the lower
+// and upper weighted quantiles.  In this case nvalid is the number of
+// darkspots given positive weight.
+//
+// If conf.DSBlacklistFile is set, the darkspots blacklisted by
+// screen_darkspots are dropped from the match sets of all villages.
+//
+// If conf.MatchPeriod is set, the darkspots that period_screen
+// excluded for the period containing a date are dropped from the
+// match sets of all villages on that date.
+//
+// Additional estimates of the background (median, winsorized mean,
+// Huber M-estimate or a quantile, see conf.BgEstimators) can be
+// written to their own files, e.g. "bg_median_##.gz", using the same
+// darkspot values and weights as the trimmed mean.
+//
+// If conf.BgPoolDays is positive, the darkspot values for all dates
+// within BgPoolDays days of each date are pooled to calculate the
+// background for the date, optionally weighted by their distance in
+// time (conf.BgPoolWeight).  In this case nvalid counts the pooled
+// values.
+//
+// Outlying darkspot values, e.g. from fires or flares, can be dropped
+// on the dates they occur: values above conf.OutlierMax, and values
+// more than conf.OutlierSD standard deviations above the darkspot's
+// long-run mean as calculated by screen_darkspots.  The number of
+// values dropped on each date is logged.
+//
+// If conf.BgMinValid or conf.BgMinValidFrac is set, the background
+// (and any additional estimates) is set to NaN for villages with
+// fewer than BgMinValid valid darkspot values before trimming, or
+// fewer than BgMinValidFrac times the number of matched darkspot
+// values (the number of matched darkspots times the number of pooled
+// dates).  The reason is written to "bgflag_##.gz" (see lights.BgOK
+// and the related constants), and subtract sets the adjusted values to
+// NaN for these villages.  Otherwise any "bgflag_##.gz" files from an
+// earlier run are removed.
+//
+// If conf.BgRobustScale is set, robust scale statistics of the
+// darkspot values are also written: the normalized median absolute
+// deviation "bmad_##.gz", the interquartile range "biqr_##.gz", and
+// the quantiles at conf.MatchLower, the median and conf.MatchUpper,
+// "bqlower_##.gz", "bqmedian_##.gz" and "bqupper_##.gz".  Comparing
+// these to bsd helps detect dates when the darkspot values are
+// bimodal or contaminated.
+//
+// If conf.BgBootstrap is positive, the trimmed mean is recalculated
+// for BgBootstrap resamples of the darkspot values, giving the
+// bootstrap standard error "bg_se_##.gz" and the limits of the
+// percentile confidence interval with coverage conf.BgBootLevel,
+// "bg_lcl_##.gz" and "bg_ucl_##.gz".  The resampling is seeded from
+// conf.BgBootSeed, the date and the chunk of villages, so the results
+// are reproducible.
+//
+// Each date is processed in chunks of conf.ChunkSize villages, which
+// are the chunks of the output files, so that only the results for the
+// chunks in progress are held in memory.  The number of chunks
+// processed at once is limited by conf.BgMemory (in megabytes) if it
+// is set.
 //
 // The structure of background is that background[i] = b implies that
 // the background vis value for village i is b.
 //
-// Run background after running reindex_columns
+// Run background after running reindex_columns and screen_darkspots
+// (and period_screen if conf.MatchPeriod is set)
 
 import (
-	"compress/gzip"
-	"encoding/gob"
 	"fmt"
 	"log"
 	"math"
+	"math/rand"
 	"os"
 	"path"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	lights "github.com/kshedden/indialights"
-	"github.com/kshedden/ziparray"
 )
 
 var (
 	// The match data (village id to array of darkspot ids)
 	match [][]int64
 
+	// The largest number of darkspots matched to one village
+	max_match int
+
+	// The largest darkspot index in match
+	max_ds int
+
+	// The number of darkspots in the darkspot index
+	nds int
+
+	// Distance kernel weights, corresponding to match (nil if
+	// the background is not weighted)
+	weights [][]float64
+
+	// Darkspots that are never used (nil if there is no blacklist)
+	blacklist []int64
+
+	// Darkspots excluded in each period (nil if the match sets do
+	// not vary by period)
+	period_excl map[string][]int64
+
+	// Darkspot values above these limits are outliers on the date
+	// they occur (nil if there are no outlier rules)
+	outlier_limit []float64
+
+	// Number of outlying darkspot values dropped, and the number
+	// of dates with outliers
+	n_outlier, n_outlier_dates int
+
+	// Additional background estimators
+	estimators []lights.BackgroundEstimator
+
 	comm chan *frec
 
 	// Semaphore to control goroutines
 	sem chan bool
 
-	// Current number or records processed
-	nproc int
+	// Tracks the running jobs
+	wg sync.WaitGroup
 
-	// Flag that the last record has been processed
-	all_sent bool
+	// Number of village chunks
+	nchunk int
 
 	logger *log.Logger
 	conf   lights.Conf
@@ -51,94 +148,584 @@ var (
 
 // Used to channel goroutine output to file writers
 type frec struct {
-	path   string
+	path      string
+	chunk_idx int
+
+	// Results for the villages in the chunk
 	tmeans []float64
 	nvalid []float64
 	bsd    []float64
+
+	// Results of the additional estimators
+	extra [][]float64
+
+	// Bootstrap standard errors and confidence limits (nil if
+	// there is no bootstrap)
+	bse  []float64
+	blcl []float64
+	bucl []float64
+
+	// Reasons that the background is missing, see support_flag
+	// (nil if there is no minimum support rule)
+	flags []float64
+
+	// Robust scale statistics, in the order of scale_names (nil if
+	// they are not calculated)
+	scale [][]float64
+}
+
+// support_flag returns the reason that the background for a village
+// with n valid darkspot values (before trimming) out of nmatch
+// matched darkspot values is set to NaN, or lights.BgOK.
+func support_flag(n, nmatch int) int {
+	switch {
+	case n == 0:
+		return lights.BgNoValid
+	case n < conf.BgMinValid:
+		return lights.BgFewValid
+	case float64(n) < conf.BgMinValidFrac*float64(nmatch):
+		return lights.BgFewValidFrac
+	}
+	return lights.BgOK
+}
+
+// Names of the robust scale statistics
+var scale_names = []string{"bmad", "biqr", "bqlower", "bqmedian", "bqupper"}
+
+// robust_scale sets the robust scale statistics in position j, using
+// the sorted values vals (weighted by wts if wts is not nil).
+func robust_scale(scale [][]float64, j int, vals, wts []float64) {
+	q1 := lights.Quantile(vals, wts, 0.25)
+	q3 := lights.Quantile(vals, wts, 0.75)
+	scale[0][j] = lights.MAD(vals, wts)
+	scale[1][j] = q3 - q1
+	scale[2][j] = lights.Quantile(vals, wts, conf.MatchLower)
+	scale[3][j] = lights.Quantile(vals, wts, 0.5)
+	scale[4][j] = lights.Quantile(vals, wts, conf.MatchUpper)
+}
+
+// kernel returns the weight for a darkspot at distance d from a
+// village.
+func kernel(d float64) float64 {
+
+	u := d / conf.BgBandwidth
+
+	switch conf.BgKernel {
+	case "inverse":
+		return 1 / (1 + u)
+	case "gaussian":
+		return math.Exp(-u * u / 2)
+	case "tricube":
+		if u >= 1 {
+			return 0
+		}
+		v := 1 - u*u*u
+		return v * v * v
+	default:
+		panic(fmt.Sprintf("unknown BgKernel %s", conf.BgKernel))
+	}
+}
+
+// The darkspot data for one date, and its weight when pooled with
+// the data for neighboring dates
+type dscol struct {
+	dvec []float64
+	wt   float64
+}
+
+// pool_weight returns the weight of the data for a date dt days
+// away from the date being processed.
+func pool_weight(dt int) float64 {
+
+	switch conf.BgPoolWeight {
+	case "":
+		return 1
+	case "triangular":
+		return 1 - math.Abs(float64(dt))/float64(conf.BgPoolDays+1)
+	default:
+		panic(fmt.Sprintf("unknown BgPoolWeight %s", conf.BgPoolWeight))
+	}
+}
+
+// bootstrap returns the bootstrap standard error and percentile
+// confidence interval of the trimmed mean of the sorted values vals
+// (weighted by wts if wts is not nil).  bv, bw and reps are
+// workspace, reps has length conf.BgBootstrap.
+func bootstrap(rng *rand.Rand, vals, wts, bv, bw, reps []float64) (float64, float64, float64) {
+
+	m := len(vals)
+	if m == 0 {
+		return math.NaN(), math.NaN(), math.NaN()
+	}
+
+	bv = bv[0:m]
+	var ws []float64
+	if wts != nil {
+		ws = bw[0:m]
+	}
+
+	nr := 0
+	for range reps {
+		for i := 0; i < m; i++ {
+			j := rng.Intn(m)
+			bv[i] = vals[j]
+			if ws != nil {
+				ws[i] = wts[j]
+			}
+		}
+		if ws != nil {
+			lights.SortWeighted(bv, ws)
+		} else {
+			sort.Float64s(bv)
+		}
+		tmean, _, _ := lights.TrimmedMean(bv, ws, conf.MatchLower, conf.MatchUpper)
+		if !math.IsNaN(tmean) {
+			reps[nr] = tmean
+			nr++
+		}
+	}
+	if nr < 2 {
+		return math.NaN(), math.NaN(), math.NaN()
+	}
+	rv := reps[0:nr]
+
+	mean := float64(0)
+	for _, x := range rv {
+		mean += x
+	}
+	mean /= float64(nr)
+	se := float64(0)
+	for _, x := range rv {
+		se += (x - mean) * (x - mean)
+	}
+	se = math.Sqrt(se / float64(nr-1))
+
+	sort.Float64s(rv)
+	a := (1 - conf.BgBootLevel) / 2
+
+	return se, lights.Quantile(rv, nil, a), lights.Quantile(rv, nil, 1-a)
+}
+
+// The darkspot data for one date, shared by the jobs for all village
+// chunks of the date
+type datejob struct {
+	path string
+
+	// The darkspot data (one date, or several dates if the data
+	// are pooled)
+	cols []dscol
+
+	// The darkspot ranks, calculated by the first job that needs
+	// them
+	once  sync.Once
+	ranks *lights.DarkspotRanks
+}
+
+// get_ranks returns the ranks of the darkspots, for unweighted,
+// unpooled data.
+func (d *datejob) get_ranks() *lights.DarkspotRanks {
+	d.once.Do(func() {
+		d.ranks = lights.NewDarkspotRanks(d.cols[0].dvec)
+	})
+	return d.ranks
+}
+
+// chunk_range returns the villages in a chunk.
+func chunk_range(chunk_idx int) (int, int) {
+	lo := chunk_idx * conf.ChunkSize
+	hi := lo + conf.ChunkSize
+	if hi > len(match) {
+		hi = len(match)
+	}
+	return lo, hi
 }
 
-// Calculate all statistics for one date
-func process(dvec []float64, path string) {
+// Calculate all statistics for one chunk of villages on one date
+func process(d *datejob, chunk_idx int) {
 
-	tmeans := make([]float64, len(match))
-	nvalid := make([]float64, len(match))
-	bsd := make([]float64, len(match))
+	defer wg.Done()
+	defer func() { <-sem }()
+
+	cols := d.cols
+	lo, hi := chunk_range(chunk_idx)
+	m := hi - lo
+
+	rj := &frec{
+		path:      d.path,
+		chunk_idx: chunk_idx,
+		tmeans:    make([]float64, m),
+		nvalid:    make([]float64, m),
+		bsd:       make([]float64, m),
+		extra:     make([][]float64, len(estimators)),
+	}
+	for k := range rj.extra {
+		rj.extra[k] = make([]float64, m)
+	}
+	if conf.BgMinValid > 0 || conf.BgMinValidFrac > 0 {
+		rj.flags = make([]float64, m)
+	}
+	if conf.BgRobustScale {
+		rj.scale = make([][]float64, len(scale_names))
+		for k := range rj.scale {
+			rj.scale[k] = make([]float64, m)
+		}
+	}
 
 	// Reusable workspace
-	buf := make([]float64, conf.MaxMatch)
+	buf := make([]float64, max_match*len(cols))
+	wbuf := make([]float64, max_match*len(cols))
+
+	// Bootstrap workspace, the random numbers for each chunk
+	// depend only on the seed, the date and the chunk, so the
+	// results are reproducible
+	var rng *rand.Rand
+	var bv, bw, reps []float64
+	if conf.BgBootstrap > 0 {
+		rj.bse = make([]float64, m)
+		rj.blcl = make([]float64, m)
+		rj.bucl = make([]float64, m)
+		day := lights.DirDate(d.path).Unix() / 86400
+		rng = rand.New(rand.NewSource(conf.BgBootSeed + day*int64(nchunk) + int64(chunk_idx)))
+		bv = make([]float64, len(buf))
+		bw = make([]float64, len(buf))
+		reps = make([]float64, conf.BgBootstrap)
+	}
 
 	// Percentile points for trimmed mean
 	p1 := conf.MatchLower
 	p2 := conf.MatchUpper
 
-	for vi_id, ix := range match {
+	weighted := weights != nil || conf.BgPoolWeight != ""
 
-		// Obtain the valid values in the match set
-		ii := 0
-		for _, i := range ix {
-			if !math.IsNaN(dvec[i]) {
-				buf[ii] = dvec[i]
-				ii++
+	// For unweighted, unpooled data, rank the darkspots once so
+	// that the match sets do not need to be sorted
+	var ranks *lights.DarkspotRanks
+	var mark []bool
+	if !weighted && len(cols) == 1 {
+		ranks = d.get_ranks()
+		mark = make([]bool, ranks.Len())
+	}
+
+	for vi_id := lo; vi_id < hi; vi_id++ {
+
+		ix := match[vi_id]
+		j := vi_id - lo
+
+		// Obtain the valid values in the match set, and their
+		// weights
+		var vals, wts []float64
+		if weighted {
+			ii := 0
+			for _, c := range cols {
+				for k, i := range ix {
+					w := c.wt
+					if weights != nil {
+						w *= weights[vi_id][k]
+					}
+					if !math.IsNaN(c.dvec[i]) && w > 0 {
+						buf[ii] = c.dvec[i]
+						wbuf[ii] = w
+						ii++
+					}
+				}
+			}
+			vals = buf[0:ii]
+			wts = wbuf[0:ii]
+			lights.SortWeighted(vals, wts)
+		} else if ranks != nil {
+			vals = ranks.SortedValues(ix, buf, mark)
+		} else {
+			ii := 0
+			for _, c := range cols {
+				for _, i := range ix {
+					if !math.IsNaN(c.dvec[i]) {
+						buf[ii] = c.dvec[i]
+						ii++
+					}
+				}
 			}
+			vals = buf[0:ii]
+			sort.Float64Slice(vals).Sort()
 		}
-		vals := buf[0:ii]
 
-		sort.Float64Slice(vals).Sort()
+		// Trimmed mean and trimmed standard deviation
+		tmean, n, sd := lights.TrimmedMean(vals, wts, p1, p2)
+		rj.tmeans[j] = tmean
+		rj.nvalid[j] = float64(n)
+		rj.bsd[j] = sd
 
-		// Trimmed mean
-		tmean := float64(0)
-		n := int(0)
-		m := len(vals)
-		j1 := int(float64(m) * p1)
-		j2 := int(float64(m) * p2)
-		for i := j1; i < j2; i++ {
-			tmean += vals[i]
-			n++
+		if rj.scale != nil {
+			robust_scale(rj.scale, j, vals, wts)
 		}
-		tmean /= float64(n)
 
-		// Standard deviation (also trimmed)
-		sd := float64(0)
-		for i := j1; i < j2; i++ {
-			u := vals[i] - tmean
-			sd += u * u
+		// Apply the minimum support rule
+		if rj.flags != nil {
+			flag := support_flag(len(vals), len(ix)*len(cols))
+			rj.flags[j] = float64(flag)
+			if flag != lights.BgOK {
+				rj.tmeans[j] = math.NaN()
+				for k := range estimators {
+					rj.extra[k][j] = math.NaN()
+				}
+				if rng != nil {
+					rj.bse[j] = math.NaN()
+					rj.blcl[j] = math.NaN()
+					rj.bucl[j] = math.NaN()
+				}
+				continue
+			}
 		}
-		sd = math.Sqrt(sd / float64(n))
 
-		tmeans[vi_id] = tmean
-		nvalid[vi_id] = float64(n)
-		bsd[vi_id] = sd
+		for k, est := range estimators {
+			rj.extra[k][j] = est.Estimate(vals, wts)
+		}
+
+		if rng != nil {
+			rj.bse[j], rj.blcl[j], rj.bucl[j] = bootstrap(rng, vals, wts, bv, bw, reps)
+		}
 	}
-	rj := &frec{path, tmeans, nvalid, bsd}
 	comm <- rj
-	<-sem
 }
 
-// Loop over the dates, read in the data for each date, and launch a
-// goroutine to do the calculations.
+// read_dscol reads the darkspot data for one date, setting the
+// blacklisted darkspots and the darkspots excluded in the period of
+// the date to NaN.
+func read_dscol(da string) ([]float64, error) {
+
+	dvec, err := lights.ReadDarkspotColumn(da, nds)
+	if err != nil {
+		return nil, err
+	}
+
+	// Drop the blacklisted darkspots
+	for _, i := range blacklist {
+		if int(i) < len(dvec) {
+			dvec[i] = math.NaN()
+		}
+	}
+
+	// Drop the darkspots excluded in this period
+	if period_excl != nil {
+		for _, i := range period_excl[lights.DatePeriod(da, conf.MatchPeriod)] {
+			if int(i) < len(dvec) {
+				dvec[i] = math.NaN()
+			}
+		}
+	}
+
+	// Drop the outlying values
+	if outlier_limit != nil {
+		n := 0
+		for i, lim := range outlier_limit {
+			if dvec[i] > lim {
+				dvec[i] = math.NaN()
+				n++
+			}
+		}
+		if n > 0 {
+			logger.Printf("%s: %d outlying darkspot values dropped\n", da, n)
+			n_outlier += n
+			n_outlier_dates++
+		}
+	}
+
+	return dvec, nil
+}
+
+// get_outlier_limits returns the limit above which the value of each
+// matched darkspot is an outlier, using conf.OutlierMax and the
+// long-run statistics from screen_darkspots with conf.OutlierSD.
+func get_outlier_limits() []float64 {
+
+	limit := make([]float64, max_ds+1)
+	for i := range limit {
+		limit[i] = math.Inf(1)
+		if conf.OutlierMax > 0 {
+			limit[i] = conf.OutlierMax
+		}
+	}
+
+	if conf.OutlierSD > 0 {
+		ds := lights.ReadDarkspotScreen(path.Join(conf.Path, "darkspot_screen.csv.gz"))
+		nlim := 0
+		for i := range limit {
+			if i >= len(ds.Nobs) || int(ds.Nobs[i]) < conf.ScreenMinObs || math.IsNaN(ds.SD[i]) {
+				continue
+			}
+			nlim++
+			limit[i] = math.Min(limit[i], ds.Mean[i]+conf.OutlierSD*ds.SD[i])
+		}
+		logger.Printf("%d darkspots have outlier limits based on their long-run statistics\n", nlim)
+	}
+
+	return limit
+}
+
+// max_jobs returns the number of village chunks that can be
+// processed at once within conf.BgMemory megabytes, which is at most
+// 40.
+func max_jobs() int {
+
+	const max = 40
+	if conf.BgMemory <= 0 {
+		return max
+	}
+
+	npool := 2*conf.BgPoolDays + 1
+	nvar := 3 + len(estimators)
+	if conf.BgMinValid > 0 || conf.BgMinValidFrac > 0 {
+		nvar++
+	}
+	if conf.BgRobustScale {
+		nvar += len(scale_names)
+	}
+	if conf.BgBootstrap > 0 {
+		nvar += 3
+	}
+
+	// Results and workspace for one chunk, and the darkspot data
+	// and ranks for its date, in bytes
+	chunk := conf.ChunkSize
+	if chunk > len(match) {
+		chunk = len(match)
+	}
+	mem := 8*chunk*nvar + 8*4*max_match*npool + 8*conf.BgBootstrap
+	mem += 8*(max_ds+1)*npool + 13*(max_ds+1)
+
+	n := int(conf.BgMemory * 1024 * 1024 / float64(mem))
+	if n < 1 {
+		n = 1
+	} else if n > max {
+		n = max
+	}
+	logger.Printf("Processing %d chunks at once\n", n)
+
+	return n
+}
+
+// vi_path returns the village directory for a darkspot date
+// directory.
+func vi_path(da string) string {
+	return strings.Replace(da, conf.DSBaseDir, conf.ViBaseDir, 1)
+}
+
+// has_villages returns true if there is village vis data for a
+// darkspot date directory, otherwise there is no need to calculate
+// the backgrounds.
+func has_villages(da string) bool {
+	_, err := os.Stat(vi_path(da))
+	if err != nil && !os.IsNotExist(err) {
+		logger.Print(err)
+	}
+	return err == nil
+}
+
+// dispatch launches a goroutine for each chunk of villages on one
+// date.
+func dispatch(d *datejob) {
+	for chunk_idx := 0; chunk_idx < nchunk; chunk_idx++ {
+		sem <- true
+		wg.Add(1)
+		go process(d, chunk_idx)
+	}
+}
+
+// Loop over the dates, read in the data for each date, and launch
+// goroutines to do the calculations.  comm is closed when all the
+// calculations are complete.
 func streamdata(dirnames []string) {
 
+	if conf.BgPoolDays > 0 {
+		streampooled(dirnames)
+	} else {
+		streamdates(dirnames)
+	}
+
+	wg.Wait()
+	close(comm)
+}
+
+// streamdates is streamdata for unpooled data.
+func streamdates(dirnames []string) {
+
 	for _, da := range dirnames {
 
-		// Read the darkspot data for one day (note there is
-		// only one chunk for darkspot data).
-		fname := path.Join(da, "vis_observed_00.gz")
-		_, err := os.Stat(fname)
-		if os.IsNotExist(err) {
-			break
+		if !has_villages(da) {
+			continue
 		}
-		dvec, err := ziparray.ReadFloat64Array(fname)
+
+		// Read the darkspot data for one day
+
+		dvec, err := read_dscol(da)
 		if err != nil {
 			logger.Print(err)
-			logger.Print(fname)
+			logger.Print(da)
 			continue
 		}
 
-		sem <- true
-		go process(dvec, da)
-		nproc++
+		dispatch(&datejob{path: da, cols: []dscol{{dvec, 1}}})
+	}
+}
+
+// streampooled is streamdata for pooled data.  The darkspot data for
+// each date are read once, and held while the date is within
+// conf.BgPoolDays days of the date being processed.
+func streampooled(dirnames []string) {
+
+	// The window requires the dates in order
+	dirnames = append([]string(nil), dirnames...)
+	sort.SliceStable(dirnames, func(i, j int) bool {
+		return lights.DirDate(dirnames[i]).Before(lights.DirDate(dirnames[j]))
+	})
+
+	dates := make([]time.Time, len(dirnames))
+	for j, da := range dirnames {
+		dates[j] = lights.DirDate(da)
+	}
+
+	// days returns the number of days from date j to date k
+	days := func(j, k int) int {
+		return int(math.Floor(dates[k].Sub(dates[j]).Hours()/24 + 0.5))
+	}
+
+	// Darkspot data for the dates in the window, by position in
+	// dirnames
+	cache := make(map[int][]float64)
+	first, next := 0, 0
+
+	for k, da := range dirnames {
+
+		// Read the dates up to BgPoolDays after this date
+		for ; next < len(dirnames) && days(k, next) <= conf.BgPoolDays; next++ {
+			dvec, err := read_dscol(dirnames[next])
+			if err != nil {
+				if !os.IsNotExist(err) {
+					logger.Print(err)
+					logger.Print(dirnames[next])
+				}
+				continue
+			}
+			cache[next] = dvec
+		}
+
+		// Drop the dates more than BgPoolDays before this date
+		for ; days(first, k) > conf.BgPoolDays; first++ {
+			delete(cache, first)
+		}
+
+		if cache[k] == nil || !has_villages(da) {
+			continue
+		}
+
+		var cols []dscol
+		for j := first; j < next; j++ {
+			if dvec, ok := cache[j]; ok {
+				cols = append(cols, dscol{dvec, pool_weight(days(j, k))})
+			}
+		}
+
+		dispatch(&datejob{path: da, cols: cols})
 	}
-	all_sent = true
 }
 
 func main() {
@@ -157,22 +744,62 @@ func main() {
 	logger = log.New(fid, "", log.Lshortfile)
 
 	// Get the match mapping
-	fname = path.Join(conf.Path, conf.MatchGobFile)
-	fid, err = os.Open(fname)
-	if err != nil {
-		panic(err)
+	match = lights.GetMatches(&conf)
+	for _, ix := range match {
+		if len(ix) > max_match {
+			max_match = len(ix)
+		}
+		for _, i := range ix {
+			if int(i) > max_ds {
+				max_ds = int(i)
+			}
+		}
 	}
-	rdr, err := gzip.NewReader(fid)
-	if err != nil {
-		panic(err)
+	nds = len(lights.ReadIdx(path.Join(conf.Path, conf.DSIndexFile)))
+	if max_ds >= nds {
+		panic(fmt.Sprintf("darkspot %d is matched, but there are %d darkspots", max_ds, nds))
 	}
-	dec := gob.NewDecoder(rdr)
-	err = dec.Decode(&match)
-	if err != nil {
-		panic(err)
+
+	// Get the distance weights
+	if conf.BgKernel != "" {
+		if conf.BgBandwidth <= 0 {
+			panic("BgBandwidth must be positive")
+		}
+		dists := lights.GetMatchDists(&conf)
+		weights = make([][]float64, len(dists))
+		for i, dv := range dists {
+			weights[i] = make([]float64, len(dv))
+			for j, d := range dv {
+				weights[i][j] = kernel(d)
+			}
+		}
+	}
+
+	// Set up the additional estimators
+	for _, name := range conf.BgEstimators {
+		est, err := lights.NewEstimator(name, &conf)
+		if err != nil {
+			panic(err)
+		}
+		estimators = append(estimators, est)
+	}
+
+	// Get the blacklisted darkspots
+	if conf.DSBlacklistFile != "" {
+		blacklist = lights.ReadBlacklist(path.Join(conf.Path, conf.DSBlacklistFile))
+		logger.Printf("%d darkspots blacklisted\n", len(blacklist))
+	}
+
+	// Get the darkspots excluded in each period
+	if conf.MatchPeriod != "" {
+		fname = path.Join(conf.Path, "darkspot_period_exclusions.gob.gz")
+		period_excl = lights.ReadPeriodExclusions(fname)
+	}
+
+	// Get the outlier limit for each darkspot
+	if conf.OutlierMax > 0 || conf.OutlierSD > 0 {
+		outlier_limit = get_outlier_limits()
 	}
-	rdr.Close()
-	fid.Close()
 
 	basepath := conf.DSBaseDir
 	basepath = path.Join(conf.Path, basepath)
@@ -182,72 +809,71 @@ func main() {
 	comm = make(chan *frec)
 
 	// Limit number of goroutines
-	sem = make(chan bool, 40)
+	nchunk = (len(match) + conf.ChunkSize - 1) / conf.ChunkSize
+	sem = make(chan bool, max_jobs())
 
 	// Calculate backgrounds in parallel
 	go streamdata(dir_names)
 
 	// Write out the backround data as it becomes ready
 	iq := 0
-	for {
-		if all_sent && iq == nproc {
-			break
-		}
-
-		qr := <-comm
+	for qr := range comm {
 		iq++
 
-		vpath := strings.Replace(qr.path, conf.DSBaseDir, conf.ViBaseDir, 1)
-
-		// If the path doesn't exist, there is no village vis
-		// data and we can skip writing these results.
-		_, err := os.Stat(vpath)
-		if os.IsNotExist(err) {
-			continue
-		} else if err != nil {
-			logger.Print(err)
-			continue
-		}
-
-		chunk_idx := -1
-		for ii := 0; ii < len(match); ii += conf.ChunkSize {
-			chunk_idx += 1
-			jj := ii + conf.ChunkSize
-			if jj > len(match) {
-				jj = len(match)
-			}
-
-			// Save means
-			fname := path.Join(vpath, fmt.Sprintf("background_%02d.gz", chunk_idx))
-			err = ziparray.WriteFloat64Array(qr.tmeans[ii:jj], fname)
+		vpath := vi_path(qr.path)
+		save := func(name string, x []float64) {
+			fname := path.Join(vpath, fmt.Sprintf("%s_%02d.gz", name, qr.chunk_idx))
+			err := lights.WriteColumn(x, fname, conf.SparseDensity)
 			if err != nil {
 				logger.Print(err)
 				logger.Print(fname)
 			}
+		}
 
-			// Save valid sample size
-			fname = path.Join(vpath, fmt.Sprintf("nvalid_%02d.gz", chunk_idx))
-			err = ziparray.WriteFloat64Array(qr.nvalid[ii:jj], fname)
+		// Save means, valid sample sizes and standard deviations
+		save("background", qr.tmeans)
+		save("nvalid", qr.nvalid)
+		save("bsd", qr.bsd)
+
+		// Save the minimum support flags, or remove any flags
+		// from an earlier run
+		if qr.flags != nil {
+			save("bgflag", qr.flags)
+		} else {
+			fname := path.Join(vpath, fmt.Sprintf("bgflag_%02d.gz", qr.chunk_idx))
+			err := lights.RemoveColumn(fname)
 			if err != nil {
 				logger.Print(err)
-				logger.Print(fname)
 			}
+		}
 
-			// Save standard deviation
-			fname = path.Join(vpath, fmt.Sprintf("bsd_%02d.gz", chunk_idx))
-			err = ziparray.WriteFloat64Array(qr.bsd[ii:jj], fname)
-			if err != nil {
-				logger.Print(err)
-				logger.Print(fname)
-			}
+		// Save the bootstrap results
+		if qr.bse != nil {
+			save("bg_se", qr.bse)
+			save("bg_lcl", qr.blcl)
+			save("bg_ucl", qr.bucl)
 		}
 
-		if iq%100 == 0 {
-			fmt.Printf("%8.5f", float64(iq)/float64(len(dir_names)))
+		// Save the robust scale statistics
+		for k, x := range qr.scale {
+			save(scale_names[k], x)
+		}
+
+		// Save the additional estimates
+		for k, est := range estimators {
+			save(est.Name(), qr.extra[k])
+		}
+
+		if iq%(100*nchunk) == 0 {
+			fmt.Printf("%8.5f", float64(iq)/float64(nchunk*len(dir_names)))
 		}
 	}
 	fmt.Printf("\n")
 
+	if outlier_limit != nil {
+		logger.Printf("%d outlying darkspot values dropped on %d dates\n", n_outlier, n_outlier_dates)
+	}
+
 	fname = path.Join(conf.Path, "background_done")
 	fid, err = os.Create(fname)
 	if err != nil {
@@ -0,0 +1,214 @@
+package main
+
+// export_matches writes the matches for selected villages to a
+// GeoJSON file, for viewing in a GIS such as QGIS.  The villages are
+// selected either by id or by a bounding box:
+//
+//   export_matches conf.json out.geojson ids v1,v2,...
+//   export_matches conf.json out.geojson idfile villages.txt
+//   export_matches conf.json out.geojson bbox minlon,minlat,maxlon,maxlat
+//
+// where villages.txt contains one village id per line.
+//
+// The output contains a point for each selected village (kind =
+// "village") and each darkspot matched to any of them (kind =
+// "darkspot"), and a line from each village to each of its matched
+// darkspots (kind = "match") with the distance in meters as an
+// attribute.
+//
+// The matches are read from conf.MatchCSRFile or conf.MatchGobFile,
+// and the village and darkspot indices from conf.ViIndexFile and
+// conf.DSIndexFile, so run export_matches after running reindex.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	lights "github.com/kshedden/indialights"
+)
+
+type geometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+type feature struct {
+	Type       string                 `json:"type"`
+	Geometry   geometry               `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type collection struct {
+	Type     string    `json:"type"`
+	Features []feature `json:"features"`
+}
+
+func point(lat, lon float64, props map[string]interface{}) feature {
+	return feature{"Feature", geometry{"Point", []float64{lon, lat}}, props}
+}
+
+func line(lat1, lon1, lat2, lon2 float64, props map[string]interface{}) feature {
+	return feature{"Feature", geometry{"LineString", [][]float64{{lon1, lat1}, {lon2, lat2}}}, props}
+}
+
+// reverse_idx returns the ids in index order, given a map from ids to
+// index positions.
+func reverse_idx(idx map[string]int64) []string {
+	ids := make([]string, len(idx))
+	for k, v := range idx {
+		ids[v] = k
+	}
+	return ids
+}
+
+// read_ids reads one id per line from a text file.
+func read_ids(fname string) []string {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	var ids []string
+	scanner := bufio.NewScanner(fid)
+	for scanner.Scan() {
+		id := strings.TrimSpace(scanner.Text())
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	return ids
+}
+
+func main() {
+
+	if len(os.Args) != 5 {
+		panic(fmt.Sprintf("usage: %s conf.json out.geojson [ids|idfile|bbox] value", os.Args[0]))
+	}
+	conf := lights.GetConf(os.Args[1])
+	outname := os.Args[2]
+
+	// Coordinates of all villages and darkspots
+	vi_ids, vi_lat, vi_lon := lights.ReadVillages(&conf)
+	vi_pos := make(map[string]int)
+	for j, v := range vi_ids {
+		vi_pos[v] = j
+	}
+	ds_keys, ds_lat, ds_lon := lights.ReadDarkspots(&conf)
+	ds_pos := make(map[string]int)
+	for j, k := range ds_keys {
+		ds_pos[k] = j
+	}
+
+	// Index positions used in the match file
+	vi_idx := lights.ReadIdx(path.Join(conf.Path, conf.ViIndexFile))
+	ds_ids := reverse_idx(lights.ReadIdx(path.Join(conf.Path, conf.DSIndexFile)))
+
+	// Select the villages (by index position)
+	var selected []int64
+	switch os.Args[3] {
+	case "ids", "idfile":
+		var ids []string
+		if os.Args[3] == "ids" {
+			ids = strings.Split(os.Args[4], ",")
+		} else {
+			ids = read_ids(os.Args[4])
+		}
+		for _, v := range ids {
+			ix, ok := vi_idx[v]
+			if !ok {
+				fmt.Printf("Village %s has no matches\n", v)
+				continue
+			}
+			selected = append(selected, ix)
+		}
+	case "bbox":
+		bb := strings.Split(os.Args[4], ",")
+		if len(bb) != 4 {
+			panic("bbox must be minlon,minlat,maxlon,maxlat")
+		}
+		var b [4]float64
+		for j := range bb {
+			var err error
+			b[j], err = strconv.ParseFloat(bb[j], 64)
+			if err != nil {
+				panic(err)
+			}
+		}
+		for v, ix := range vi_idx {
+			j, ok := vi_pos[v]
+			if !ok {
+				continue
+			}
+			if vi_lon[j] >= b[0] && vi_lat[j] >= b[1] && vi_lon[j] <= b[2] && vi_lat[j] <= b[3] {
+				selected = append(selected, ix)
+			}
+		}
+	default:
+		panic(fmt.Sprintf("%s not recognized", os.Args[3]))
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i] < selected[j] })
+
+	match := lights.GetMatches(&conf)
+	var dists [][]float64
+	if conf.MatchDistCol > 0 {
+		dists = lights.GetMatchDists(&conf)
+	}
+
+	vi_names := reverse_idx(vi_idx)
+	features := make([]feature, 0)
+	ds_done := make(map[int64]bool)
+	for _, ix := range selected {
+		vid := vi_names[ix]
+		j := vi_pos[vid]
+		props := map[string]interface{}{"kind": "village", "id": vid, "index": ix, "nmatch": len(match[ix])}
+		features = append(features, point(vi_lat[j], vi_lon[j], props))
+
+		for k, dx := range match[ix] {
+			dsid := ds_ids[dx]
+			i, ok := ds_pos[dsid]
+			if !ok {
+				panic(fmt.Sprintf("darkspot %s is not in %s", dsid, conf.DSLatLonFile))
+			}
+
+			if !ds_done[dx] {
+				props := map[string]interface{}{"kind": "darkspot", "id": dsid, "index": dx}
+				features = append(features, point(ds_lat[i], ds_lon[i], props))
+				ds_done[dx] = true
+			}
+
+			var d float64
+			if dists != nil {
+				d = dists[ix][k]
+			} else {
+				d = lights.GeoDistance(vi_lat[j], vi_lon[j], ds_lat[i], ds_lon[i])
+			}
+			props := map[string]interface{}{"kind": "match", "village": vid, "darkspot": dsid, "distance": d}
+			features = append(features, line(vi_lat[j], vi_lon[j], ds_lat[i], ds_lon[i], props))
+		}
+	}
+
+	fid, err := os.Create(outname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	enc := json.NewEncoder(fid)
+	err = enc.Encode(collection{"FeatureCollection", features})
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("Wrote %d villages and %d darkspots to %s\n", len(selected), len(ds_done), outname)
+}
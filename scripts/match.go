@@ -1,28 +1,81 @@
 package main
 
 // match takes lat/lon coordinates for darkspots and village, and
-// identifies all the darkspots that lie in a rectangle centered at
-// each village.
+// identifies all the darkspots that lie within geodesic distance
+// conf.MTol of each village.  Alternatively (conf.MatchMode = "knn"),
+// the conf.MatchK darkspots that are nearest to each village are
+// identified.  The darkspots are held in a lights.GeoIndex, which
+// gives exact geodesic distances at all latitudes.
+//
+// Each line of the output file contains the village id, darkspot id,
+// village latitude and longitude, and the geodesic distance in meters
+// between the village and darkspot.
+//
+// Darkspots closer than conf.MinDist to a village are not matched to
+// it, so that the matched darkspots lie in an annulus around the
+// village.  The number of matched and excluded darkspots for each
+// village are written to match_diagnostics.csv.gz.
+//
+// Matching can be constrained (conf.MatchConstraint) so that a
+// village is only matched to darkspots in the same state, district,
+// or polygon of conf.BoundaryFile.  If fewer than
+// conf.MinConstrainedMatch darkspots satisfy the constraint, it is
+// relaxed from district to state, and then to no constraint.  The
+// constraint that was used for each village is recorded in the
+// diagnostics file.
+//
+// Darkspots lying inside any polygon of the GeoJSON layers listed in
+// conf.ExclusionFiles (e.g. water bodies or areas with fires or gas
+// flares) are dropped before matching.  The number of darkspots
+// dropped by each layer is written to darkspot_exclusions.csv.
+//
+// If covariate files are given (conf.DSCovFile and conf.ViCovFile),
+// the darkspots that are matched geographically to a village are
+// ranked by the distance between their covariates (conf.CovNames) and
+// those of the village, and the conf.CovK most similar darkspots are
+// kept.  The covariates are standardized using the pooled darkspot
+// and village data, and compared by Euclidean or Mahalanobis distance
+// (conf.CovDistance).  Villages without covariate data keep their
+// geographic matches, and darkspots without covariate data are ranked
+// last.
+//
+// At most conf.MaxMatch darkspots are matched to each village.  When
+// more are available, conf.MaxMatchPolicy determines which are kept:
+// "nearest" (the default) keeps the nearest ones, "random" keeps a
+// random subsample (seeded by conf.MatchSeed and the village
+// position, so it is reproducible), and "bearing" divides the
+// darkspots into conf.MatchSectors sectors by their bearing from the
+// village and takes the nearest darkspots from each sector in turn.
+// The number of darkspots dropped for each village is recorded in the
+// diagnostics file.
+//
+// Villages are matched in parallel by conf.MatchWorkers workers.  The
+// output is written in village order, and in order of increasing
+// distance within each village, so it does not depend on the number
+// of workers.
 //
 // This is usually the first script to run on a new data set
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
 	"fmt"
+	"math"
+	"math/rand"
 	"os"
 	"path"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 
-	"github.com/dhconnelly/rtreego"
 	lights "github.com/kshedden/indialights"
-	"github.com/paulmach/go.geo"
 )
 
 const (
-	// Small box at each darkspot
-	etol = 0.01
+	// Number of villages matched by a worker at a time
+	batch_size = 1000
 )
 
 var (
@@ -32,10 +85,32 @@ var (
 	vi_lon []float64
 	vi_id  []string
 
-	rt *rtreego.Rtree
+	// Darkspot ids (see lights.DarkspotKey)
+	ds_key []string
+
+	ds_index *lights.GeoIndex
+
+	match_func func(float64, float64, func(int) bool, *vi_diag) ([]int, []float64)
+
+	// Standardized covariates of the darkspots and villages (nil
+	// for those with missing data), and the inverse covariance
+	// matrix used for the covariate distance
+	ds_cov  [][]float64
+	vi_cov  [][]float64
+	cov_inv [][]float64
+
+	// Region codes of the darkspots and villages for each level of
+	// the matching constraint, from the finest to the coarsest
+	region_names []string
+	ds_region    [][]string
+	vi_region    [][]string
+
+	conf lights.Conf
 )
 
-func get_latlon(fname string, id_ix, lat_ix, lon_ix int) ([]string, []float64, []float64) {
+// get_columns returns the values in the given columns of a gzipped
+// csv file.
+func get_columns(fname string, cols ...int) [][]string {
 
 	fid, err := os.Open(fname)
 	if err != nil {
@@ -48,44 +123,623 @@ func get_latlon(fname string, id_ix, lat_ix, lon_ix int) ([]string, []float64, [
 	}
 	defer rdr.Close()
 
-	latvec := make([]float64, 0)
-	lonvec := make([]float64, 0)
-	var idvec []string
-	if id_ix != -1 {
-		idvec = make([]string, 0)
-	}
+	vals := make([][]string, len(cols))
 	scanner := bufio.NewScanner(rdr)
 	for scanner.Scan() {
-		line := scanner.Text()
-		line = strings.TrimRight(line, "\n")
-		fields := strings.Split(line, ",")
-		lat, err := strconv.ParseFloat(fields[lat_ix], 64)
+		fields := strings.Split(scanner.Text(), ",")
+		for j, c := range cols {
+			vals[j] = append(vals[j], fields[c])
+		}
+	}
+
+	return vals
+}
+
+// setup_regions determines the region codes of the villages and
+// darkspots for the matching constraint.  A village with an empty
+// region code is not constrained at that level.
+func setup_regions() {
+
+	switch conf.MatchConstraint {
+	case "":
+		return
+	case "state", "district":
+		// The state and district codes are the first two
+		// columns of the village information file
+		fname := path.Join(conf.Path, conf.ViInfoFile)
+		vi := get_columns(fname, 0, 1)
+
+		// Columns 0 and 1 of the darkspot file are the
+		// coordinates, so the code columns must be set
+		if conf.DSStateCol < 2 {
+			panic("DSStateCol must be set to a column after the darkspot coordinates")
+		}
+		dist_col := conf.DSStateCol
+		if conf.MatchConstraint == "district" {
+			if conf.DSDistCol < 2 {
+				panic("DSDistCol must be set to a column after the darkspot coordinates")
+			}
+			dist_col = conf.DSDistCol
+		}
+		fname = path.Join(conf.Path, conf.DSLatLonFile)
+		ds := get_columns(fname, conf.DSStateCol, dist_col)
+
+		// District codes are only unique within states
+		for j := range vi[0] {
+			vi[1][j] = vi[0][j] + ":" + vi[1][j]
+		}
+		for j := range ds[0] {
+			ds[1][j] = ds[0][j] + ":" + ds[1][j]
+		}
+
+		region_names = []string{"state"}
+		ds_region = [][]string{ds[0]}
+		vi_region = [][]string{vi[0]}
+		if conf.MatchConstraint == "district" {
+			region_names = []string{"district", "state"}
+			ds_region = [][]string{ds[1], ds[0]}
+			vi_region = [][]string{vi[1], vi[0]}
+		}
+	case "polygon":
+		fname := path.Join(conf.Path, conf.BoundaryFile)
+		layer, err := lights.ReadPolygonLayer(fname, "")
+		if err != nil {
+			panic(err)
+		}
+		locate := func(lat, lon []float64) []string {
+			codes := make([]string, len(lat))
+			for j := range lat {
+				if k := layer.Locate(lat[j], lon[j]); k != -1 {
+					codes[j] = layer.Name(k)
+				}
+			}
+			return codes
+		}
+		region_names = []string{"polygon"}
+		ds_region = [][]string{locate(ds_lat, ds_lon)}
+		vi_region = [][]string{locate(vi_lat, vi_lon)}
+	default:
+		panic(fmt.Sprintf("unknown MatchConstraint %s", conf.MatchConstraint))
+	}
+}
+
+// exclude_darkspots drops the darkspots that fall inside the
+// exclusion layers.  A darkspot that is inside several layers is
+// counted for the first of them.
+func exclude_darkspots() {
+
+	if len(conf.ExclusionFiles) == 0 {
+		return
+	}
+
+	keep := make([]bool, len(ds_lat))
+	for i := range keep {
+		keep[i] = true
+	}
+
+	ndrop := make([]int, len(conf.ExclusionFiles))
+	for j, fn := range conf.ExclusionFiles {
+		layer, err := lights.ReadPolygonLayer(path.Join(conf.Path, fn), "")
 		if err != nil {
 			panic(err)
 		}
-		lon, err := strconv.ParseFloat(fields[lon_ix], 64)
+		for i := range ds_lat {
+			if keep[i] && layer.Locate(ds_lat[i], ds_lon[i]) != -1 {
+				keep[i] = false
+				ndrop[j]++
+			}
+		}
+	}
+
+	jj := 0
+	for i := range ds_lat {
+		if !keep[i] {
+			continue
+		}
+		ds_key[jj] = ds_key[i]
+		ds_lat[jj] = ds_lat[i]
+		ds_lon[jj] = ds_lon[i]
+		for _, r := range ds_region {
+			r[jj] = r[i]
+		}
+		jj++
+	}
+	ds_key = ds_key[0:jj]
+	ds_lat = ds_lat[0:jj]
+	ds_lon = ds_lon[0:jj]
+	for lev := range ds_region {
+		ds_region[lev] = ds_region[lev][0:jj]
+	}
+
+	// Report the number of darkspots dropped by each layer
+	fname := path.Join(conf.Path, "darkspot_exclusions.csv")
+	fid, err := os.Create(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	_, err = fid.Write([]byte("layer,dropped\n"))
+	if err != nil {
+		panic(err)
+	}
+	for j, fn := range conf.ExclusionFiles {
+		fmt.Printf("Dropped %d darkspots in %s\n", ndrop[j], fn)
+		_, err = fid.Write([]byte(fmt.Sprintf("%s,%d\n", fn, ndrop[j])))
 		if err != nil {
 			panic(err)
 		}
-		latvec = append(latvec, lat)
-		lonvec = append(lonvec, lon)
-		if id_ix != -1 {
-			idvec = append(idvec, fields[id_ix])
+	}
+	fmt.Printf("%d darkspots remain\n", jj)
+}
+
+// read_covariates reads the covariates named in conf.CovNames from a
+// gzipped csv file with a header row.  The key of each row is
+// obtained by applying keyfunc to the fields, rows for which keyfunc
+// returns "" are skipped and repeated keys are an error.  Rows with
+// missing or non-numeric covariate values are not returned.
+func read_covariates(fname string, keyfunc func([]string) string) map[string][]float64 {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	rdr, err := gzip.NewReader(fid)
+	if err != nil {
+		panic(err)
+	}
+	defer rdr.Close()
+
+	scanner := bufio.NewScanner(rdr)
+	if !scanner.Scan() {
+		panic(fmt.Sprintf("%s is empty", fname))
+	}
+	head := strings.Split(scanner.Text(), ",")
+	cols := make([]int, len(conf.CovNames))
+	for j, na := range conf.CovNames {
+		cols[j] = -1
+		for i, h := range head {
+			if strings.TrimSpace(h) == na {
+				cols[j] = i
+			}
+		}
+		if cols[j] == -1 {
+			panic(fmt.Sprintf("covariate %s not found in %s", na, fname))
+		}
+	}
+
+	cov := make(map[string][]float64)
+	seen := make(map[string]bool)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		key := keyfunc(fields)
+		if key == "" {
+			continue
+		}
+		if seen[key] {
+			panic(fmt.Sprintf("%s contains %s more than once", fname, key))
+		}
+		seen[key] = true
+
+		x := make([]float64, len(cols))
+		ok := true
+		for j, c := range cols {
+			if c >= len(fields) {
+				ok = false
+				break
+			}
+			x[j], err = strconv.ParseFloat(strings.TrimSpace(fields[c]), 64)
+			if err != nil || math.IsNaN(x[j]) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			cov[key] = x
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	return cov
+}
+
+// copy_covariates returns a copy of the covariates for the given
+// keys, with nil rows for the keys that have no covariates.
+func copy_covariates(cov map[string][]float64, keys []string) [][]float64 {
+
+	p := len(conf.CovNames)
+	x := make([][]float64, len(keys))
+	for i, k := range keys {
+		if v, ok := cov[k]; ok {
+			x[i] = make([]float64, p)
+			copy(x[i], v)
+		}
+	}
+
+	return x
+}
+
+// invert returns the inverse of a symmetric positive definite matrix,
+// using Gauss-Jordan elimination.
+func invert(a [][]float64) [][]float64 {
+
+	p := len(a)
+	m := make([][]float64, p)
+	inv := make([][]float64, p)
+	for i := range a {
+		m[i] = append([]float64(nil), a[i]...)
+		inv[i] = make([]float64, p)
+		inv[i][i] = 1
+	}
+
+	for c := 0; c < p; c++ {
+		// Partial pivoting
+		r := c
+		for i := c + 1; i < p; i++ {
+			if math.Abs(m[i][c]) > math.Abs(m[r][c]) {
+				r = i
+			}
+		}
+		if math.Abs(m[r][c]) < 1e-12 {
+			panic("covariance matrix of the covariates is singular")
+		}
+		m[c], m[r] = m[r], m[c]
+		inv[c], inv[r] = inv[r], inv[c]
+
+		d := m[c][c]
+		for j := 0; j < p; j++ {
+			m[c][j] /= d
+			inv[c][j] /= d
+		}
+		for i := 0; i < p; i++ {
+			if i == c || m[i][c] == 0 {
+				continue
+			}
+			f := m[i][c]
+			for j := 0; j < p; j++ {
+				m[i][j] -= f * m[c][j]
+				inv[i][j] -= f * inv[c][j]
+			}
+		}
+	}
+
+	return inv
+}
+
+// setup_covariates reads and standardizes the darkspot and village
+// covariates.
+func setup_covariates() {
+
+	if conf.DSCovFile == "" && conf.ViCovFile == "" {
+		return
+	}
+	if conf.DSCovFile == "" || conf.ViCovFile == "" || len(conf.CovNames) == 0 {
+		panic("DSCovFile, ViCovFile and CovNames are all needed for covariate matching")
+	}
+	if conf.CovK <= 0 {
+		panic("CovK must be positive")
+	}
+
+	// Darkspot covariate files are keyed like DSLatLonFile, and
+	// village covariate files have the village id in the first
+	// column.
+	fname := path.Join(conf.Path, conf.DSCovFile)
+	dsc := read_covariates(fname, func(fields []string) string {
+		key, err := lights.DarkspotKey(&conf, fields, 0, 1, conf.DSLatLonIdCol)
+		if err != nil {
+			return ""
+		}
+		return key
+	})
+	fname = path.Join(conf.Path, conf.ViCovFile)
+	vic := read_covariates(fname, func(fields []string) string { return fields[0] })
+
+	// Copy the covariates, so that each row is standardized once
+	// even if it is shared
+	ds_cov = copy_covariates(dsc, ds_key)
+	vi_cov = copy_covariates(vic, vi_id)
+
+	// Standardize using the pooled data
+	p := len(conf.CovNames)
+	mean := make([]float64, p)
+	sd := make([]float64, p)
+	n := 0
+	for _, rows := range [][][]float64{ds_cov, vi_cov} {
+		for _, x := range rows {
+			if x == nil {
+				continue
+			}
+			n++
+			for j, v := range x {
+				mean[j] += v
+				sd[j] += v * v
+			}
+		}
+	}
+	if n < 2 {
+		panic("too few observations with covariate data")
+	}
+	for j := range mean {
+		mean[j] /= float64(n)
+		sd[j] = math.Sqrt(sd[j]/float64(n) - mean[j]*mean[j])
+		if sd[j] == 0 {
+			panic(fmt.Sprintf("covariate %s is constant", conf.CovNames[j]))
+		}
+	}
+
+	cov := make([][]float64, p)
+	for j := range cov {
+		cov[j] = make([]float64, p)
+	}
+	for _, rows := range [][][]float64{ds_cov, vi_cov} {
+		for _, x := range rows {
+			if x == nil {
+				continue
+			}
+			for j := range x {
+				x[j] = (x[j] - mean[j]) / sd[j]
+			}
+			for j1 := range x {
+				for j2 := range x {
+					cov[j1][j2] += x[j1] * x[j2] / float64(n)
+				}
+			}
+		}
+	}
+
+	switch conf.CovDistance {
+	case "", "euclidean":
+		cov_inv = make([][]float64, p)
+		for j := range cov_inv {
+			cov_inv[j] = make([]float64, p)
+			cov_inv[j][j] = 1
+		}
+	case "mahalanobis":
+		cov_inv = invert(cov)
+	default:
+		panic(fmt.Sprintf("unknown CovDistance %s", conf.CovDistance))
+	}
+}
+
+// cov_dist returns the squared covariate distance between village k
+// and darkspot i, which is infinite if the darkspot has no covariate
+// data.
+func cov_dist(k, i int) float64 {
+
+	x := vi_cov[k]
+	y := ds_cov[i]
+	if y == nil {
+		return math.Inf(1)
+	}
+
+	d := float64(0)
+	for j1 := range x {
+		for j2 := range x {
+			d += (x[j1] - y[j1]) * cov_inv[j1][j2] * (x[j2] - y[j2])
+		}
+	}
+
+	return d
+}
+
+// rank_covariates keeps the CovK matches of village k whose
+// covariates are closest to those of the village (ties are broken by
+// geographic distance).  The matches must be sorted by distance, and
+// the retained matches remain sorted by distance.
+func rank_covariates(k int, ix []int, dists []float64) ([]int, []float64) {
+
+	if vi_cov == nil || vi_cov[k] == nil || len(ix) <= conf.CovK {
+		return ix, dists
+	}
+
+	cd := make([]float64, len(ix))
+	pos := make([]int, len(ix))
+	for j, i := range ix {
+		cd[j] = cov_dist(k, i)
+		pos[j] = j
+	}
+	sort.SliceStable(pos, func(a, b int) bool { return cd[pos[a]] < cd[pos[b]] })
+	pos = pos[0:conf.CovK]
+
+	sort.Ints(pos)
+	for j, p := range pos {
+		ix[j] = ix[p]
+		dists[j] = dists[p]
+	}
+
+	return ix[0:len(pos)], dists[0:len(pos)]
+}
+
+// Diagnostic information about the matches for one village
+type vi_diag struct {
+
+	// Number of darkspots satisfying the matching constraint that
+	// are excluded for being closer than MinDist
+	nnear int
+
+	// The level of the matching constraint that was used
+	constraint string
+
+	// Number of darkspots dropped to respect MaxMatch
+	ndropped int
+}
+
+// drop_near removes the darkspots that are closer than MinDist to the
+// village, and records the number removed in diag.  The darkspots
+// must be sorted by distance.
+func drop_near(ix []int, dists []float64, diag *vi_diag) ([]int, []float64) {
+
+	j := 0
+	for j < len(ix) && dists[j] < conf.MinDist {
+		j++
+	}
+	diag.nnear = j
+
+	return ix[j:], dists[j:]
+}
+
+// keep_only retains the darkspots for which keep returns true (all
+// darkspots if keep is nil).
+func keep_only(ix []int, dists []float64, keep func(int) bool) ([]int, []float64) {
+
+	if keep == nil {
+		return ix, dists
+	}
+
+	jj := 0
+	for j, i := range ix {
+		if keep(i) {
+			ix[jj] = i
+			dists[jj] = dists[j]
+			jj++
+		}
+	}
+
+	return ix[0:jj], dists[0:jj]
+}
+
+// radius_match returns the darkspots whose distance from (lat, lon)
+// is between MinDist and MTol meters and that satisfy keep, in order
+// of increasing distance.
+func radius_match(lat, lon float64, keep func(int) bool, diag *vi_diag) ([]int, []float64) {
+
+	ix, dists := ds_index.Within(lat, lon, conf.MTol)
+	ix, dists = keep_only(ix, dists, keep)
+
+	return drop_near(ix, dists, diag)
+}
+
+// knn_match returns the MatchK darkspots nearest to (lat, lon) that
+// are at least MinDist meters away and that satisfy keep, in order of
+// increasing distance.  If MTol is positive only darkspots within
+// MTol meters are returned.
+func knn_match(lat, lon float64, keep func(int) bool, diag *vi_diag) ([]int, []float64) {
+
+	// The darkspots closer than MinDist that satisfy keep
+	near := make(map[int]bool)
+	if conf.MinDist > 0 {
+		ix, dists := ds_index.Within(lat, lon, conf.MinDist)
+		for j, i := range ix {
+			if dists[j] < conf.MinDist && (keep == nil || keep(i)) {
+				near[i] = true
+			}
+		}
+	}
+	diag.nnear = len(near)
+
+	return ds_index.Nearest(lat, lon, conf.MatchK, conf.MTol, func(i int) bool {
+		return (keep == nil || keep(i)) && !near[i]
+	})
+}
+
+// match_village returns the matches for village k, applying the
+// matching constraint.  If fewer than MinConstrainedMatch darkspots
+// satisfy the constraint at one level, the next coarser level is
+// used, and finally no constraint is used.
+func match_village(k int, diag *vi_diag) ([]int, []float64) {
+
+	for lev, name := range region_names {
+		code := vi_region[lev][k]
+		if code == "" {
+			continue
+		}
+		keep := func(i int) bool { return ds_region[lev][i] == code }
+		var d vi_diag
+		ix, dists := match_func(vi_lat[k], vi_lon[k], keep, &d)
+		if len(ix) >= conf.MinConstrainedMatch {
+			diag.nnear = d.nnear
+			diag.constraint = name
+			return ix, dists
+		}
+	}
+
+	diag.constraint = "none"
+	return match_func(vi_lat[k], vi_lon[k], nil, diag)
+}
+
+// cap_matches reduces the matches for village k to at most MaxMatch
+// darkspots, using the selection policy MaxMatchPolicy.  The
+// matches must be sorted by distance, and the retained matches
+// remain sorted by distance.
+func cap_matches(k int, ix []int, dists []float64, diag *vi_diag) ([]int, []float64) {
+
+	diag.ndropped = 0
+	if conf.MaxMatch <= 0 || len(ix) <= conf.MaxMatch {
+		return ix, dists
+	}
+	diag.ndropped = len(ix) - conf.MaxMatch
+
+	// Positions (in ix) of the retained matches
+	var pos []int
+
+	switch conf.MaxMatchPolicy {
+	case "", "nearest":
+		return ix[0:conf.MaxMatch], dists[0:conf.MaxMatch]
+	case "random":
+		rng := rand.New(rand.NewSource(conf.MatchSeed + int64(k)))
+		pos = rng.Perm(len(ix))[0:conf.MaxMatch]
+	case "bearing":
+		nsec := conf.MatchSectors
+		sectors := make([][]int, nsec)
+		for j, i := range ix {
+			b := lights.Bearing(vi_lat[k], vi_lon[k], ds_lat[i], ds_lon[i])
+			s := int(b * float64(nsec) / 360)
+			if s >= nsec {
+				s = nsec - 1
+			}
+			sectors[s] = append(sectors[s], j)
+		}
+		for r := 0; len(pos) < conf.MaxMatch; r++ {
+			for _, sec := range sectors {
+				if r < len(sec) && len(pos) < conf.MaxMatch {
+					pos = append(pos, sec[r])
+				}
+			}
 		}
 	}
 
-	return idvec, latvec, lonvec
+	sort.Ints(pos)
+	for j, p := range pos {
+		ix[j] = ix[p]
+		dists[j] = dists[p]
+	}
+
+	return ix[0:len(pos)], dists[0:len(pos)]
 }
 
-type DarkSpot struct {
-	location rtreego.Point
-	idx      string
+// The output lines for one batch of villages
+type batch struct {
+	idx   int
+	lines []byte
+	diags []byte
 }
 
-func (s *DarkSpot) Bounds() *rtreego.Rect {
-	// define the bounds of s to be a rectangle centered at s.location
-	// with side lengths 2 * etol:
-	return s.location.ToRect(etol)
+// match_batch matches the villages in batch b and formats the
+// output.
+func match_batch(b int) *batch {
+
+	var lines, diags bytes.Buffer
+	var diag vi_diag
+
+	k2 := (b + 1) * batch_size
+	if k2 > len(vi_lat) {
+		k2 = len(vi_lat)
+	}
+	for k := b * batch_size; k < k2; k++ {
+
+		matches, dists := match_village(k, &diag)
+		matches, dists = rank_covariates(k, matches, dists)
+		matches, dists = cap_matches(k, matches, dists, &diag)
+
+		fmt.Fprintf(&diags, "%s,%d,%d,%s,%d\n", vi_id[k], len(matches), diag.nnear, diag.constraint, diag.ndropped)
+		for j, i := range matches {
+			fmt.Fprintf(&lines, "%s,%s,%.8f,%.8f,%.1f\n", vi_id[k], ds_key[i], vi_lat[k], vi_lon[k], dists[j])
+		}
+	}
+
+	return &batch{b, lines.Bytes(), diags.Bytes()}
 }
 
 func main() {
@@ -93,23 +747,44 @@ func main() {
 	if len(os.Args) != 2 {
 		panic("usage: match conf.json")
 	}
-	conf := lights.GetConf(os.Args[1])
+	conf = lights.GetConf(os.Args[1])
 
-	// Read the coordinates of darkspots and villages
-	fname := path.Join(conf.Path, conf.DSLatLonFile)
-	_, ds_lat, ds_lon = get_latlon(fname, -1, 0, 1)
-	fname = path.Join(conf.Path, conf.ViInfoFile)
-	vi_id, vi_lat, vi_lon = get_latlon(fname, 3, 4, 5)
+	switch conf.MatchMode {
+	case "", "radius":
+		match_func = radius_match
+	case "box":
+		panic("MatchMode box is no longer supported, the LatTol/LonTol box was replaced by the radius MTol (MatchMode radius)")
+	case "knn":
+		if conf.MatchK <= 0 {
+			panic("MatchK must be positive in knn mode")
+		}
+		match_func = knn_match
+	default:
+		panic(fmt.Sprintf("unknown MatchMode %s", conf.MatchMode))
+	}
 
-	// Build a tree of darkspots
-	rt = rtreego.NewTree(2, 25, 50)
-	for k := 0; k < len(ds_lat); k++ {
-		idxs := fmt.Sprintf("%.8f:%.8f", ds_lat[k], ds_lon[k])
-		rt.Insert(&DarkSpot{rtreego.Point{ds_lat[k], ds_lon[k]}, idxs})
+	switch conf.MaxMatchPolicy {
+	case "", "nearest", "random":
+	case "bearing":
+		if conf.MatchSectors <= 0 {
+			panic("MatchSectors must be positive for the bearing policy")
+		}
+	default:
+		panic(fmt.Sprintf("unknown MaxMatchPolicy %s", conf.MaxMatchPolicy))
 	}
 
+	// Read the coordinates of darkspots and villages
+	ds_key, ds_lat, ds_lon = lights.ReadDarkspots(&conf)
+	vi_id, vi_lat, vi_lon = lights.ReadVillages(&conf)
+	setup_regions()
+	exclude_darkspots()
+	setup_covariates()
+
+	// Build an index of darkspots
+	ds_index = lights.NewGeoIndex(ds_lat, ds_lon)
+
 	// Set up file for writing output
-	fname = path.Join(conf.Path, "match_raw.txt.gz")
+	fname := path.Join(conf.Path, "match_raw.txt.gz")
 	out, err := os.Create(fname)
 	if err != nil {
 		panic(err)
@@ -118,36 +793,73 @@ func main() {
 	wtr := gzip.NewWriter(out)
 	defer wtr.Close()
 
-	// Query for each village
-	for k := 0; k < len(vi_lat); k++ {
-
-		point := rtreego.Point{vi_lat[k] - conf.LatTol, vi_lon[k] - conf.LonTol}
-		lengths := []float64{2 * conf.LonTol, 2 * conf.LonTol}
-		bb, _ := rtreego.NewRect(point, lengths)
-
-		matches := rt.SearchIntersect(bb)
+	// Set up file for writing match diagnostics
+	fname = path.Join(conf.Path, "match_diagnostics.csv.gz")
+	dout, err := os.Create(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer dout.Close()
+	dwtr := gzip.NewWriter(dout)
+	defer dwtr.Close()
+	_, err = dwtr.Write([]byte("village,nmatch,nnear,constraint,ndropped\n"))
+	if err != nil {
+		panic(err)
+	}
 
-		vi_pt := geo.NewPointFromLatLng(vi_lat[k], vi_lon[k])
+	nworkers := conf.MatchWorkers
+	if nworkers <= 0 {
+		nworkers = runtime.NumCPU()
+	}
+	nbatch := (len(vi_lat) + batch_size - 1) / batch_size
 
-		for _, ma := range matches {
-			mav := ma.(*DarkSpot)
+	// Limits the number of batches that are in progress or
+	// waiting to be written
+	sem := make(chan bool, 2*nworkers)
 
-			ds_pt := geo.NewPointFromLatLng(mav.location[0], mav.location[1])
-			dis := vi_pt.GeoDistanceFrom(ds_pt, true)
-			if dis > conf.MTol {
-				continue
+	jobs := make(chan int)
+	results := make(chan *batch)
+	go func() {
+		for b := 0; b < nbatch; b++ {
+			sem <- true
+			jobs <- b
+		}
+		close(jobs)
+	}()
+	for w := 0; w < nworkers; w++ {
+		go func() {
+			for b := range jobs {
+				results <- match_batch(b)
 			}
+		}()
+	}
 
-			line := fmt.Sprintf("%s,%s,%.8f,%.8f\n", vi_id[k], mav.idx, vi_lat[k], vi_lon[k])
-			_, err = wtr.Write([]byte(line))
+	// Write the batches in order as they become available
+	pending := make(map[int]*batch)
+	for next := 0; next < nbatch; {
+		ba := <-results
+		pending[ba.idx] = ba
+		for {
+			ba, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			_, err = wtr.Write(ba.lines)
 			if err != nil {
 				panic(err)
 			}
-		}
+			_, err = dwtr.Write(ba.diags)
+			if err != nil {
+				panic(err)
+			}
+			<-sem
+			next++
 
-		// Progress report
-		if k%10000 == 0 {
-			fmt.Printf("%7.4f", float64(k)/float64(len(vi_lat)))
+			// Progress report
+			if next%10 == 0 {
+				fmt.Printf("%7.4f", float64(next)/float64(nbatch))
+			}
 		}
 	}
 	fmt.Printf("\nDone\n")
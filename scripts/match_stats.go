@@ -1,97 +1,473 @@
-package indialights
+package main
 
-// match_stats calculates some summary statistics from the matching
-// process.
+// match_stats calculates summary statistics from the matching
+// process, for quality control.  It reads the raw match file and the
+// match diagnostics produced by match, and writes the following files
+// into the directory "match_report":
 //
-// This is currently incomplete and not part of the main data
-// processing pipeline.
+// villages.csv.gz: for each village, the number of matched
+// darkspots, the diagnostics from match (the number of darkspots
+// excluded by MinDist, the matching constraint that was used and the
+// number of darkspots dropped by MaxMatch), and the minimum, median,
+// mean and maximum distance (in meters) to its matched darkspots.
+//
+// few_matches.csv: the villages with fewer than conf.ReportMinMatch
+// matches (including villages with no matches).
+//
+// darkspots.csv.gz: for each darkspot, the number of villages it is
+// matched to.
+//
+// summary.json: overall counts, totals of the match diagnostics, the
+// number of villages matched under each constraint, quantiles of the
+// per-village match counts, darkspot reuse and median distances, and
+// histograms of the distances and of the latitude and longitude
+// differences between darkspots and villages.
+//
+// The distance statistics are only calculated if conf.MatchDistCol is
+// set.
+//
+// Run match_stats after running match.
 
 import (
 	"bufio"
 	"compress/gzip"
+	"encoding/json"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 
 	lights "github.com/kshedden/indialights"
 )
 
-func stats() {
+const (
+	// Width of the dlat/dlon histogram bins, in degrees
+	deg_bin = 0.1
+
+	// Width of the distance histogram bins, in meters
+	dist_bin = 10000.0
+)
+
+var (
+	conf lights.Conf
+)
+
+// A histogram bin, covering [Lower, Lower + width)
+type bin struct {
+	Lower float64
+	Count int64
+}
+
+// Quantiles of a distribution
+type quantiles struct {
+	Min    float64
+	Q10    float64
+	Q25    float64
+	Median float64
+	Q75    float64
+	Q90    float64
+	Max    float64
+}
+
+// Match diagnostics for one village, from match_diagnostics.csv.gz
+type diagnostics struct {
+	nnear      int
+	constraint string
+	ndropped   int
+}
+
+// Distance statistics for one village
+type dist_stats struct {
+	min  float64
+	med  float64
+	mean float64
+	max  float64
+}
+
+type summary struct {
+	NVillage        int
+	NVillageMatched int
+	NVillageZero    int
+	NVillageFew     int
+	ReportMinMatch  int
+	NDarkspot       int
+	NDarkspotUsed   int
+	NMatch          int64
+	NNear           int64
+	NDropped        int64
+	NVillageDropped int
+	Constraint      map[string]int
+	MatchCount      quantiles
+	DarkspotReuse   quantiles
+	MedianDistance  quantiles
+	DistanceBin     float64
+	DistanceHist    []bin
+	DegreeBin       float64
+	DLatHist        []bin
+	DLonHist        []bin
+}
+
+// get_quantiles returns the quantiles of x, which are all zero if x
+// is empty.
+func get_quantiles(x []float64) quantiles {
+
+	if len(x) == 0 {
+		return quantiles{}
+	}
+
+	sort.Float64s(x)
+	q := func(p float64) float64 {
+		return x[int(p*float64(len(x)-1)+0.5)]
+	}
+
+	return quantiles{q(0), q(0.1), q(0.25), q(0.5), q(0.75), q(0.9), q(1)}
+}
+
+func get_hist(counts map[int]int64, width float64) []bin {
+
+	keys := make([]int, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	hist := make([]bin, len(keys))
+	for j, k := range keys {
+		hist[j] = bin{float64(k) * width, counts[k]}
+	}
+
+	return hist
+}
+
+// read_column returns one column of a gzipped csv file.
+func read_column(fname string, col int) []string {
 
-	fname := path.Join(conf.Path, conf.MatchRawFile)
 	fid, err := os.Open(fname)
 	if err != nil {
 		panic(err)
 	}
+	defer fid.Close()
 	rdr, err := gzip.NewReader(fid)
 	if err != nil {
 		panic(err)
 	}
+	defer rdr.Close()
 
+	var vals []string
 	scanner := bufio.NewScanner(rdr)
-	dlat_dist := make([]int64, 52)
-	dlon_dist := make([]int64, 52)
-	nline := 0
 	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		vals = append(vals, fields[col])
+	}
 
-		line := scanner.Text()
-		line = strings.TrimRight(line, "\n")
-		fields := strings.Split(line, ",")
+	return vals
+}
 
-		vi_lat, err := strconv.ParseFloat(fields[2], 64)
+// read_diagnostics returns the match diagnostics for each village.
+func read_diagnostics(fname string) map[string]diagnostics {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	rdr, err := gzip.NewReader(fid)
+	if err != nil {
+		panic(err)
+	}
+	defer rdr.Close()
+
+	scanner := bufio.NewScanner(rdr)
+	if !scanner.Scan() {
+		panic(fmt.Sprintf("%s is empty", fname))
+	}
+	col := make(map[string]int)
+	for j, h := range strings.Split(scanner.Text(), ",") {
+		col[h] = j
+	}
+	for _, h := range []string{"village", "nnear", "constraint", "ndropped"} {
+		if _, ok := col[h]; !ok {
+			panic(fmt.Sprintf("%s has no column %s", fname, h))
+		}
+	}
+
+	diag := make(map[string]diagnostics)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		nnear, err := strconv.Atoi(fields[col["nnear"]])
 		if err != nil {
 			panic(err)
 		}
-		vi_lon, err := strconv.ParseFloat(fields[3], 64)
+		ndropped, err := strconv.Atoi(fields[col["ndropped"]])
 		if err != nil {
 			panic(err)
 		}
+		diag[fields[col["village"]]] = diagnostics{nnear, fields[col["constraint"]], ndropped}
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	return diag
+}
+
+func create_gz(fname string) (*os.File, *gzip.Writer) {
+	fid, err := os.Create(fname)
+	if err != nil {
+		panic(err)
+	}
+	return fid, gzip.NewWriter(fid)
+}
+
+func write_line(wtr io.Writer, format string, args ...interface{}) {
+	_, err := fmt.Fprintf(wtr, format, args...)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func main() {
+
+	if len(os.Args) != 2 {
+		panic(fmt.Sprintf("usage: %s conf.json", os.Args[0]))
+	}
+	conf = lights.GetConf(os.Args[1])
+	use_dist := conf.MatchDistCol > 0
+
+	outpath := path.Join(conf.Path, "match_report")
+	err := os.MkdirAll(outpath, 0777)
+	if err != nil {
+		panic(err)
+	}
+
+	// All villages and darkspots, including those with no matches
+	fname := path.Join(conf.Path, conf.ViInfoFile)
+	villages := read_column(fname, 3)
+	ds_keys, ds_lats, ds_lons := lights.ReadDarkspots(&conf)
+
+	// Number of villages matched to each darkspot, and position of
+	// each darkspot in ds_keys
+	ds_count := make(map[string]int)
+	ds_pos := make(map[string]int)
+	for j, k := range ds_keys {
+		ds_count[k] = 0
+		ds_pos[k] = j
+	}
+
+	// Number of darkspots matched to each village
+	vi_count := make(map[string]int)
+
+	// Distances for the current village
+	var vi_dist []float64
+	var cur_vi string
+
+	// Distance statistics for each matched village
+	vi_stats := make(map[string]dist_stats)
+
+	// Median distance for each village
+	var med_dist []float64
+
+	flush := func() {
+		if cur_vi == "" || !use_dist {
+			return
+		}
+		sort.Float64s(vi_dist)
+		mean := float64(0)
+		for _, d := range vi_dist {
+			mean += d
+		}
+		mean /= float64(len(vi_dist))
+		med := vi_dist[len(vi_dist)/2]
+		med_dist = append(med_dist, med)
+		vi_stats[cur_vi] = dist_stats{vi_dist[0], med, mean, vi_dist[len(vi_dist)-1]}
+		vi_dist = vi_dist[0:0]
+	}
+
+	dlat_hist := make(map[int]int64)
+	dlon_hist := make(map[int]int64)
+	dist_hist := make(map[int]int64)
 
-		fields1 := strings.Split(fields[1], ":")
-		ds_lat, err := strconv.ParseFloat(fields1[0], 64)
+	fname = path.Join(conf.Path, conf.MatchRawFile)
+	mid, err := os.Open(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer mid.Close()
+	rdr, err := gzip.NewReader(mid)
+	if err != nil {
+		panic(err)
+	}
+	defer rdr.Close()
+
+	var nmatch int64
+	scanner := bufio.NewScanner(rdr)
+	for scanner.Scan() {
+
+		fields := strings.Split(scanner.Text(), ",")
+
+		vid := fields[conf.MatchViIdCol]
+		dsid := fields[conf.MatchDSIdCol]
+
+		vi_lat, err := strconv.ParseFloat(fields[2], 64)
 		if err != nil {
 			panic(err)
 		}
-		ds_lon, err := strconv.ParseFloat(fields1[1], 64)
+		vi_lon, err := strconv.ParseFloat(fields[3], 64)
 		if err != nil {
 			panic(err)
 		}
+		var dist float64
+		if use_dist {
+			dist, err = strconv.ParseFloat(fields[conf.MatchDistCol], 64)
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		j, ok := ds_pos[dsid]
+		if !ok {
+			panic(fmt.Sprintf("darkspot %s is not in %s", dsid, conf.DSLatLonFile))
+		}
+		ds_lat := ds_lats[j]
+		ds_lon := ds_lons[j]
 
-		dlat := ds_lat - vi_lat
-		dlon := ds_lon - vi_lon
-		nline++
+		// Matches are grouped by village
+		if vid != cur_vi {
+			flush()
+			cur_vi = vid
+		}
+		if use_dist {
+			vi_dist = append(vi_dist, dist)
+		}
 
-		dlat_ix := int((dlat + 2.6) * 10)
-		dlon_ix := int((dlon + 2.6) * 10)
-		dlat_dist[dlat_ix]++
-		dlon_dist[dlon_ix]++
+		vi_count[vid]++
+		ds_count[dsid]++
+		nmatch++
 
-		if nline%10000000 == 0 {
-			for k := 0; k < len(dlat_dist); k++ {
-				fmt.Printf("%.2f %d\n", (float64(k)-26)/10, dlon_dist[k])
-			}
+		dlat_hist[int(math.Floor((ds_lat-vi_lat)/deg_bin))]++
+		dlon_hist[int(math.Floor((ds_lon-vi_lon)/deg_bin))]++
+		if use_dist {
+			dist_hist[int(math.Floor(dist/dist_bin))]++
+		}
+
+		if nmatch%10000000 == 0 {
+			fmt.Printf("%d ", nmatch)
 		}
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+	flush()
+	fmt.Printf("\n")
 
-		if math.Abs(dlat) > 2.6 {
-			msg := fmt.Sprintf("%v %v %v\n", ds_lat, vi_lat, dlat)
-			panic(msg)
+	smry := new(summary)
+	smry.Constraint = make(map[string]int)
+
+	// Per-village statistics
+	diag := read_diagnostics(path.Join(conf.Path, "match_diagnostics.csv.gz"))
+	fid, vi_out := create_gz(path.Join(outpath, "villages.csv.gz"))
+	write_line(vi_out, "village,nmatch,nnear,constraint,ndropped")
+	if use_dist {
+		write_line(vi_out, ",dist_min,dist_median,dist_mean,dist_max")
+	}
+	write_line(vi_out, "\n")
+	for _, v := range villages {
+		dg, ok := diag[v]
+		if !ok {
+			panic(fmt.Sprintf("village %s is not in the match diagnostics", v))
 		}
-		if math.Abs(dlon) > 2.6 {
-			msg := fmt.Sprintf("%v %v %v\n", ds_lon, vi_lon, dlon)
-			panic(msg)
+		smry.NNear += int64(dg.nnear)
+		smry.NDropped += int64(dg.ndropped)
+		if dg.ndropped > 0 {
+			smry.NVillageDropped++
 		}
+		smry.Constraint[dg.constraint]++
+
+		write_line(vi_out, "%s,%d,%d,%s,%d", v, vi_count[v], dg.nnear, dg.constraint, dg.ndropped)
+		if st, ok := vi_stats[v]; ok {
+			write_line(vi_out, ",%.1f,%.1f,%.1f,%.1f", st.min, st.med, st.mean, st.max)
+		} else if use_dist {
+			write_line(vi_out, ",,,,")
+		}
+		write_line(vi_out, "\n")
 	}
-}
+	vi_out.Close()
+	fid.Close()
 
-func main() {
+	// Villages with too few matches
+	smry.ReportMinMatch = conf.ReportMinMatch
+	fid, err = os.Create(path.Join(outpath, "few_matches.csv"))
+	if err != nil {
+		panic(err)
+	}
+	write_line(fid, "village,nmatch\n")
+	counts := make([]float64, 0, len(villages))
+	for _, v := range villages {
+		n := vi_count[v]
+		counts = append(counts, float64(n))
+		if n == 0 {
+			smry.NVillageZero++
+		} else {
+			smry.NVillageMatched++
+		}
+		if n < conf.ReportMinMatch {
+			smry.NVillageFew++
+			write_line(fid, "%s,%d\n", v, n)
+		}
+	}
+	fid.Close()
 
-	if len(os.Args) != 2 {
-		panic(fmt.Sprintf("usage: %s conf.json", os.Args[0]))
+	// Darkspot reuse
+	fid, ds_out := create_gz(path.Join(outpath, "darkspots.csv.gz"))
+	write_line(ds_out, "darkspot,nvillage\n")
+	keys := make([]string, 0, len(ds_count))
+	for k := range ds_count {
+		keys = append(keys, k)
 	}
-	conf = lights.GetConf(os.Args[1])
+	sort.Strings(keys)
+	reuse := make([]float64, 0, len(keys))
+	for _, k := range keys {
+		write_line(ds_out, "%s,%d\n", k, ds_count[k])
+		reuse = append(reuse, float64(ds_count[k]))
+		if ds_count[k] > 0 {
+			smry.NDarkspotUsed++
+		}
+	}
+	ds_out.Close()
+	fid.Close()
+
+	smry.NVillage = len(villages)
+	smry.NDarkspot = len(keys)
+	smry.NMatch = nmatch
+	smry.MatchCount = get_quantiles(counts)
+	smry.DarkspotReuse = get_quantiles(reuse)
+	if use_dist {
+		smry.MedianDistance = get_quantiles(med_dist)
+		smry.DistanceBin = dist_bin
+		smry.DistanceHist = get_hist(dist_hist, dist_bin)
+	}
+	smry.DegreeBin = deg_bin
+	smry.DLatHist = get_hist(dlat_hist, deg_bin)
+	smry.DLonHist = get_hist(dlon_hist, deg_bin)
+
+	b, err := json.MarshalIndent(smry, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fid, err = os.Create(path.Join(outpath, "summary.json"))
+	if err != nil {
+		panic(err)
+	}
+	_, err = fid.Write(b)
+	if err != nil {
+		panic(err)
+	}
+	fid.Close()
 
-	stats()
+	fmt.Printf("%d villages, %d with no matches, %d with fewer than %d matches\n",
+		smry.NVillage, smry.NVillageZero, smry.NVillageFew, conf.ReportMinMatch)
 }
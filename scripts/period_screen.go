@@ -0,0 +1,155 @@
+package main
+
+// period_screen identifies darkspots that are not dark during some
+// periods (years or months, see conf.MatchPeriod).  A darkspot is
+// excluded from the match sets of all villages during a period if its
+// mean vis value in the period exceeds conf.PeriodThreshold, based on
+// at least conf.PeriodMinObs observed values.
+//
+// The excluded darkspots for each period are written to
+// darkspot_period_exclusions.gob.gz as a map from the period to an
+// array of darkspot indices, and background ignores these darkspots
+// for dates in the period.  A summary with the number of excluded
+// darkspots per period is written to darkspot_period_exclusions.csv.
+//
+// Run period_screen after running reindex_columns for the darkspots.
+// It does nothing if conf.MatchPeriod is empty.
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path"
+	"sort"
+
+	lights "github.com/kshedden/indialights"
+)
+
+var (
+	logger *log.Logger
+)
+
+// Sums and counts of the observed values for each darkspot within one
+// period
+type period_stats struct {
+	sum []float64
+	n   []int
+}
+
+func main() {
+
+	if len(os.Args) != 2 {
+		panic(fmt.Sprintf("usage: %s conf.json", os.Args[0]))
+	}
+	conf := lights.GetConf(os.Args[1])
+
+	fname := path.Join(conf.Path, "period_screen.log")
+	fid, err := os.Create(fname)
+	if err != nil {
+		panic(err)
+	}
+	logger = log.New(fid, "", log.Lshortfile)
+
+	if conf.MatchPeriod != "" {
+		screen(conf)
+	}
+
+	// Write empty file to signal completion.
+	fname = path.Join(conf.Path, "period_screen_done")
+	fid, err = os.Create(fname)
+	if err != nil {
+		panic(err)
+	}
+	fid.Close()
+}
+
+func screen(conf lights.Conf) {
+
+	basepath := path.Join(conf.Path, conf.DSBaseDir)
+	dir_names := lights.GetDirNames(basepath)
+	nds := len(lights.ReadIdx(path.Join(conf.Path, conf.DSIndexFile)))
+
+	stats := make(map[string]*period_stats)
+	for k, dir := range dir_names {
+
+		dvec, err := lights.ReadDarkspotColumn(dir, nds)
+		if err != nil {
+			logger.Print(err)
+			logger.Print(dir)
+			continue
+		}
+
+		pe := lights.DatePeriod(dir, conf.MatchPeriod)
+		st, ok := stats[pe]
+		if !ok {
+			st = &period_stats{make([]float64, nds), make([]int, nds)}
+			stats[pe] = st
+		}
+
+		for i, v := range dvec {
+			if !math.IsNaN(v) {
+				st.sum[i] += v
+				st.n[i]++
+			}
+		}
+
+		if k%100 == 0 {
+			fmt.Printf("%8.5f", float64(k)/float64(len(dir_names)))
+		}
+	}
+	fmt.Printf("\n")
+
+	periods := make([]string, 0, len(stats))
+	for pe := range stats {
+		periods = append(periods, pe)
+	}
+	sort.Strings(periods)
+
+	excl := make(map[string][]int64)
+	fname := path.Join(conf.Path, "darkspot_period_exclusions.csv")
+	sfid, err := os.Create(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer sfid.Close()
+	_, err = sfid.Write([]byte("period,excluded,screened\n"))
+	if err != nil {
+		panic(err)
+	}
+	for _, pe := range periods {
+		st := stats[pe]
+		ex := make([]int64, 0)
+		nscreen := 0
+		for i := range st.sum {
+			if st.n[i] < conf.PeriodMinObs {
+				continue
+			}
+			nscreen++
+			if st.sum[i]/float64(st.n[i]) > conf.PeriodThreshold {
+				ex = append(ex, int64(i))
+			}
+		}
+		excl[pe] = ex
+		_, err = sfid.Write([]byte(fmt.Sprintf("%s,%d,%d\n", pe, len(ex), nscreen)))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	fname = path.Join(conf.Path, "darkspot_period_exclusions.gob.gz")
+	fid, err := os.Create(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	wtr := gzip.NewWriter(fid)
+	defer wtr.Close()
+	enc := gob.NewEncoder(wtr)
+	err = enc.Encode(excl)
+	if err != nil {
+		panic(err)
+	}
+}
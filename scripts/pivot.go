@@ -1,15 +1,14 @@
 package main
 
 // pivot converts column-oriented data (one column per date) to
-// row-oriented time series files.
+// row-oriented time series files.  The column files may be stored in
+// either dense or sparse form.
 
 import (
-	"bytes"
 	"compress/gzip"
 	"encoding/binary"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"math"
 	"os"
@@ -46,29 +45,22 @@ func do_chunk(chunk_idx int) {
 	wtr := gzip.NewWriter(out)
 	defer wtr.Close()
 
-	// Load the gzipped data into memory as compressed blobs and
-	// create a gzip reader for each date.
-	source := make([]*gzip.Reader, len(dir_names))
+	// Load the column data into memory (dense columns are kept as
+	// compressed blobs) and create a reader for each date.
+	source := make([]*lights.ColumnReader, len(dir_names))
 	for k, date := range dir_names {
 
-		// dat is a compressed binary blob
 		fname := path.Join(date, fmt.Sprintf("%s_%02d.gz", base_filename, chunk_idx))
-		fid, err := os.Open(fname)
-		if err != nil {
+		source[k], err = lights.OpenColumn(fname)
+		if os.IsNotExist(err) {
 			logger.Print(fmt.Sprintf("Missing: %s\n", fname))
 			continue
-		}
-		dat, err := ioutil.ReadAll(fid)
-		if err != nil {
+		} else if err != nil {
 			logger.Print(fmt.Sprintf("chunk %d\n", chunk_idx))
 			logger.Printf(fmt.Sprintf("date %s\n", date))
 			logger.Print(err)
 			panic(err)
 		}
-		fid.Close()
-
-		buf := bytes.NewBuffer(dat)
-		source[k], err = gzip.NewReader(buf)
 		defer source[k].Close()
 	}
 
@@ -85,7 +77,7 @@ func do_chunk(chunk_idx int) {
 				bvec[k] = math.NaN()
 			} else {
 				// Read one value from the source
-				err = binary.Read(source[k], binary.LittleEndian, &bvec[k])
+				bvec[k], err = source[k].Next()
 				if err == io.EOF {
 					return
 				} else if err != nil {
@@ -11,6 +11,14 @@ package main
 // i2, i3, ...] and vis = [v1, v2, v3, ...] then the vis value for
 // village/darkspots i1 is v1, etc.
 //
+// Darkspots are identified by lights.DarkspotKey, the same key used by
+// match.  Raw rows whose id is not in the index file are skipped.  The
+// ids that are not known at all are written (with the number of
+// skipped rows for each) to raw_villages_unmatched.csv.gz or
+// raw_darkspots_unmatched.csv.gz.  The darkspots that are known (in
+// conf.DSLatLonFile) but not matched to any village are written to
+// raw_darkspots_unused.csv.gz.
+//
 // Run this program after running reindex
 
 import (
@@ -21,6 +29,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -96,6 +105,43 @@ func drain_buffers(buffers map[string]*bytes.Buffer, basepath string, final bool
 	fmt.Printf(" Drained %d buffers...", ndrain)
 }
 
+// Id used in the unmatched report for the raw darkspot rows whose key
+// cannot be formed
+const invalid_key = "(invalid)"
+
+// write_skipped writes the ids of the skipped raw rows, with the
+// number of raw rows for each.  what describes the ids.
+func write_skipped(skipped map[string]int, fname, what string) {
+
+	keys := make([]string, 0, len(skipped))
+	nrow := 0
+	for k, n := range skipped {
+		keys = append(keys, k)
+		nrow += n
+	}
+	sort.Strings(keys)
+
+	fid, err := os.Create(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	wtr := gzip.NewWriter(fid)
+	defer wtr.Close()
+	_, err = wtr.Write([]byte("id,rows\n"))
+	if err != nil {
+		panic(err)
+	}
+	for _, k := range keys {
+		_, err = wtr.Write([]byte(fmt.Sprintf("%s,%d\n", k, skipped[k])))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	fmt.Printf("\n%d raw rows with %d distinct ids %s\n", nrow, len(keys), what)
+}
+
 func main() {
 
 	if len(os.Args) != 3 {
@@ -165,6 +211,22 @@ func main() {
 
 	buffers := make(map[string]*bytes.Buffer)
 
+	// Number of raw rows for each id that is not in the index
+	unmatched := make(map[string]int)
+
+	// The keys of all darkspots, so that darkspots that are not
+	// matched to any village can be distinguished from keys that do
+	// not line up with the darkspot file
+	var known map[string]bool
+	unused := make(map[string]int)
+	if mode == darkspot_mode {
+		keys, _, _ := lights.ReadDarkspots(&conf)
+		known = make(map[string]bool, len(keys))
+		for _, k := range keys {
+			known[k] = true
+		}
+	}
+
 	// Loop through the input file
 	scanner := bufio.NewScanner(rdr)
 	line_count := -1
@@ -188,8 +250,13 @@ func main() {
 		if mode == village_mode {
 			idv = vals[conf.ViIdCol]
 		} else if mode == darkspot_mode {
-			// Darkspots are always indexed by coordinates appended like this
-			idv = vals[lat_col] + ":" + vals[lon_col]
+			// Use the same darkspot keys as match
+			idv, err = lights.DarkspotKey(&conf, vals, lat_col, lon_col, conf.DSIdCol)
+			if err != nil {
+				// Rows without a valid key (e.g. a header) are
+				// reported as unmatched
+				idv = invalid_key
+			}
 		} else {
 			panic("unrecognized mode")
 		}
@@ -205,6 +272,11 @@ func main() {
 		// If not in the match file, skip it
 		id, ok := idx[idv]
 		if !ok {
+			if known[idv] {
+				unused[idv]++
+			} else {
+				unmatched[idv]++
+			}
 			continue
 		}
 
@@ -224,6 +296,12 @@ func main() {
 	}
 
 	drain_buffers(buffers, basepath, true)
+	write_skipped(unmatched, path.Join(conf.Path, fmt.Sprintf("raw_%s_unmatched.csv.gz", mode_string)),
+		"were not recognized")
+	if mode == darkspot_mode {
+		write_skipped(unused, path.Join(conf.Path, "raw_darkspots_unused.csv.gz"),
+			"are darkspots that are not matched to any village")
+	}
 
 	// Write empty file to signal completion.
 	if mode == village_mode {
@@ -14,6 +14,16 @@ package main
 // matched to dark spots j1, j2, ... All the i/j values here are
 // int64.
 //
+// If the raw match file has a distance column (conf.MatchDistCol),
+// the distances are written to conf.MatchDistFile with the same
+// structure, i.e. dist[i][k] is the distance in meters between
+// village i and darkspot match[i][k].
+//
+// If conf.MatchCSRFile is set, the matches and distances are instead
+// written to that file in binary compressed sparse row form (see
+// lights.WriteMatchCSR), which can be memory-mapped by the later
+// stages rather than decoded.
+//
 // Run this script after running match
 
 import (
@@ -26,6 +36,7 @@ import (
 	"os"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
 
 	lights "github.com/kshedden/indialights"
@@ -66,6 +77,38 @@ func map_to_csv(mp map[int64]int, fname, title string) {
 	fid.Close()
 }
 
+// write_gob writes the matches to conf.MatchGobFile, and the
+// distances (if not nil) to conf.MatchDistFile.
+func write_gob(conf lights.Conf, matches [][]int64, match_dists [][]float64) {
+
+	fmt.Printf("\nWriting matches to disk...\n")
+	encode(path.Join(conf.Path, conf.MatchGobFile), matches)
+	fmt.Printf("Done\n")
+
+	if match_dists != nil {
+		fmt.Printf("Writing match distances to disk...\n")
+		encode(path.Join(conf.Path, conf.MatchDistFile), match_dists)
+		fmt.Printf("Done\n")
+	}
+}
+
+// encode writes x to a gzipped gob file.
+func encode(fname string, x interface{}) {
+
+	fid, err := os.Create(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	wtr := gzip.NewWriter(fid)
+	defer wtr.Close()
+	enc := gob.NewEncoder(wtr)
+	err = enc.Encode(x)
+	if err != nil {
+		panic(err)
+	}
+}
+
 func main() {
 
 	if len(os.Args) != 2 {
@@ -130,6 +173,12 @@ func main() {
 	// matched to each village
 	matches := make([][]int64, 0)
 
+	// The distances corresponding to matches
+	var match_dists [][]float64
+	if conf.MatchDistCol > 0 {
+		match_dists = make([][]float64, 0)
+	}
+
 	// Match counts (village to darkspot and darkspot to village)
 	match_count_vi := make(map[int64]int)
 	match_count_ds := make(map[int64]int)
@@ -162,6 +211,20 @@ func main() {
 			logger.Print(msg)
 			continue
 		}
+		var dist float64
+		if conf.MatchDistCol > 0 {
+			if conf.MatchDistCol >= len(fields) {
+				msg := fmt.Sprintf("Skipping incomplete line %d in %s\n", line_count, conf.MatchRawFile)
+				logger.Print(msg)
+				continue
+			}
+			dist, err = strconv.ParseFloat(fields[conf.MatchDistCol], 64)
+			if err != nil {
+				msg := fmt.Sprintf("Skipping line %d in %s: %v\n", line_count, conf.MatchRawFile, err)
+				logger.Print(msg)
+				continue
+			}
+		}
 
 		// Look up the village id, create a new id if needed
 		var vi_ix, ds_ix int64
@@ -196,27 +259,29 @@ func main() {
 			matches = append(matches, make([]int64, 0, 20))
 		}
 		matches[vi_ix] = append(matches[vi_ix], ds_ix)
+		if match_dists != nil {
+			if vi_ix >= int64(len(match_dists)) {
+				match_dists = append(match_dists, make([]float64, 0, 20))
+			}
+			match_dists[vi_ix] = append(match_dists[vi_ix], dist)
+		}
 		line_count++
 
 		match_count_vi[vi_ix]++
 		match_count_ds[ds_ix]++
 	}
 
-	fmt.Printf("\nWriting matches to disk...\n")
-	fname = path.Join(conf.Path, conf.MatchGobFile)
-	fid, err = os.Create(fname)
-	if err != nil {
-		panic(err)
-	}
-	defer fid.Close()
-	wtr := gzip.NewWriter(fid)
-	defer wtr.Close()
-	enc := gob.NewEncoder(wtr)
-	err = enc.Encode(matches)
-	if err != nil {
-		panic(err)
+	if conf.MatchCSRFile != "" {
+		fmt.Printf("\nWriting matches to disk...\n")
+		fname = path.Join(conf.Path, conf.MatchCSRFile)
+		err = lights.WriteMatchCSR(fname, matches, match_dists)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Done\n")
+	} else {
+		write_gob(conf, matches, match_dists)
 	}
-	fmt.Printf("Done\n")
 
 	fmt.Printf("Writing match counts to disk...\n")
 	fname = path.Join(conf.Path, "village_match_counts.csv.gz")
@@ -2,10 +2,15 @@ package main
 
 // reindex_columns creates a column of values for each darkspot or
 // village, in which the data for the values with id=i is stored in
-// position i of the array.  The array is then split into blocks and
+// position i of the array.  The array is then split into blocks of
+// conf.ChunkSize values (conf.DSChunkSize for darkspots, if set) and
 // saved in separate files.  The arrays are written to files named
-// "vis_observed_##.gz".  After running this script, the files "vis.gz"
-// and "id.gz" are no longer needed and can be deleted.
+// "vis_observed_##.gz", or "vis_observed_##.sparse.gz" when few of the
+// values in the chunk are observed (see conf.SparseDensity).  Chunk
+// files past the last chunk written, e.g. from an earlier run with a
+// smaller chunk size, are removed.  After
+// running this script, the files "vis.gz" and "id.gz" are no longer
+// needed and can be deleted.
 //
 // The structure of vis_observed is that vis_observed[i] = v implies
 // that village/darkspot i has vis value v.
@@ -23,7 +28,6 @@ import (
 	"sync"
 
 	lights "github.com/kshedden/indialights"
-	"github.com/kshedden/ziparray"
 )
 
 type mode_type int
@@ -42,7 +46,7 @@ var (
 	wg sync.WaitGroup
 )
 
-func process(dname string, n_rec int) {
+func process(dname string, n_rec, chunk_size int) {
 
 	defer wg.Done()
 
@@ -83,19 +87,35 @@ func process(dname string, n_rec int) {
 
 	// Write out the arrray in chunks
 	chunk_idx := 0
-	for ii := 0; ii < len(rv); ii += conf.ChunkSize {
+	for ii := 0; ii < len(rv); ii += chunk_size {
 		fname = path.Join(dname, fmt.Sprintf("vis_observed_%02d.gz", chunk_idx))
-		jj := ii + conf.ChunkSize
+		jj := ii + chunk_size
 		if jj > len(rv) {
 			jj = len(rv)
 		}
-		err = ziparray.WriteFloat64Array(rv[ii:jj], fname)
+		err = lights.WriteColumn(rv[ii:jj], fname, conf.SparseDensity)
 		if err != nil {
 			panic(err)
 		}
 		chunk_idx += 1
 	}
 
+	// Remove the chunks left by an earlier run with more records or a
+	// smaller chunk size, so that they are not read as part of this
+	// column
+	for ; ; chunk_idx++ {
+		fname = path.Join(dname, fmt.Sprintf("vis_observed_%02d.gz", chunk_idx))
+		_, err1 := os.Stat(fname)
+		_, err2 := os.Stat(lights.SparseName(fname))
+		if os.IsNotExist(err1) && os.IsNotExist(err2) {
+			break
+		}
+		err = lights.RemoveColumn(fname)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	<-sem
 }
 
@@ -109,6 +129,7 @@ func main() {
 	var indexfname string
 	var basepath string
 	var mode mode_type
+	chunk_size := conf.ChunkSize
 	if os.Args[2] == "villages" {
 		indexfname = conf.ViIndexFile
 		basepath = conf.ViBaseDir
@@ -117,6 +138,9 @@ func main() {
 		indexfname = conf.DSIndexFile
 		basepath = conf.DSBaseDir
 		mode = darkspot_mode
+		if conf.DSChunkSize > 0 {
+			chunk_size = conf.DSChunkSize
+		}
 	} else {
 		panic(fmt.Sprintf("%s not recognized", os.Args[2]))
 	}
@@ -133,7 +157,7 @@ func main() {
 	for _, fn := range dir_names {
 		sem <- true
 		wg.Add(1)
-		go process(fn, n_rec)
+		go process(fn, n_rec, chunk_size)
 	}
 
 	wg.Wait()
@@ -0,0 +1,233 @@
+package main
+
+// screen_darkspots checks that the darkspots are actually dark.  For
+// each darkspot it calculates the following long-run statistics from
+// the vis_observed values on all dates:
+//
+// nobs: the number of observed (non-NaN) values
+//
+// mean: the mean vis value
+//
+// sd: the standard deviation of the vis values
+//
+// lit_frac: the fraction of nights with vis above conf.ScreenThreshold
+//
+// trend: the least squares slope of vis on time, in vis units per year
+//
+// These are written to darkspot_screen.csv.gz.  Darkspots with at
+// least conf.ScreenMinObs observed values whose mean exceeds
+// conf.ScreenMaxMean, whose lit_frac exceeds conf.ScreenMaxLitFrac,
+// or whose trend exceeds conf.ScreenMaxTrend are blacklisted (a limit
+// of 0 disables the corresponding check).  The blacklist is written to
+// conf.DSBlacklistFile, with the darkspot index, key and the reasons
+// for exclusion, and background ignores the blacklisted darkspots.
+// If conf.DSBlacklistFile is empty only the statistics are written.
+//
+// Run screen_darkspots after running reindex_columns for the
+// darkspots.
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"strings"
+
+	lights "github.com/kshedden/indialights"
+)
+
+var (
+	logger *log.Logger
+)
+
+// Running statistics for each darkspot, updated with Welford's
+// method: the means of y and t, and the sums of squared deviations
+// and cross products about the means.  t is the time in years since
+// the first date.
+type ds_stats struct {
+	n    []float64
+	nlit []float64
+	my   []float64
+	mt   []float64
+	syy  []float64
+	stt  []float64
+	sty  []float64
+}
+
+func new_stats(n int) *ds_stats {
+	return &ds_stats{
+		n:    make([]float64, n),
+		nlit: make([]float64, n),
+		my:   make([]float64, n),
+		mt:   make([]float64, n),
+		syy:  make([]float64, n),
+		stt:  make([]float64, n),
+		sty:  make([]float64, n),
+	}
+}
+
+// update adds the value y at time t to the statistics of darkspot i.
+func (st *ds_stats) update(i int, t, y float64) {
+	st.n[i]++
+	dy := y - st.my[i]
+	dt := t - st.mt[i]
+	st.my[i] += dy / st.n[i]
+	st.mt[i] += dt / st.n[i]
+	st.syy[i] += dy * (y - st.my[i])
+	st.stt[i] += dt * (t - st.mt[i])
+	st.sty[i] += dt * (y - st.my[i])
+}
+
+func write_line(wtr io.Writer, format string, args ...interface{}) {
+	_, err := fmt.Fprintf(wtr, format, args...)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func main() {
+
+	if len(os.Args) != 2 {
+		panic(fmt.Sprintf("usage: %s conf.json", os.Args[0]))
+	}
+	conf := lights.GetConf(os.Args[1])
+
+	fname := path.Join(conf.Path, "screen_darkspots.log")
+	fid, err := os.Create(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	logger = log.New(fid, "", log.Lshortfile)
+
+	// Darkspot keys in index order
+	ds_idx := lights.ReadIdx(path.Join(conf.Path, conf.DSIndexFile))
+	ds_keys := make([]string, len(ds_idx))
+	for k, v := range ds_idx {
+		ds_keys[v] = k
+	}
+
+	basepath := path.Join(conf.Path, conf.DSBaseDir)
+	dir_names := lights.GetDirNames(basepath)
+	if len(dir_names) == 0 {
+		panic(fmt.Sprintf("no dates found in %s", basepath))
+	}
+	t0 := lights.DirDate(dir_names[0])
+	for _, dir := range dir_names {
+		if t := lights.DirDate(dir); t.Before(t0) {
+			t0 = t
+		}
+	}
+
+	stats := new_stats(len(ds_keys))
+	for k, dir := range dir_names {
+
+		dvec, err := lights.ReadDarkspotColumn(dir, len(ds_keys))
+		if err != nil {
+			logger.Print(err)
+			logger.Print(dir)
+			continue
+		}
+
+		t := lights.DirDate(dir).Sub(t0).Hours() / (24 * 365.25)
+		for i, y := range dvec {
+			if math.IsNaN(y) {
+				continue
+			}
+			if y > conf.ScreenThreshold {
+				stats.nlit[i]++
+			}
+			stats.update(i, t, y)
+		}
+
+		if k%100 == 0 {
+			fmt.Printf("%8.5f", float64(k)/float64(len(dir_names)))
+		}
+	}
+	fmt.Printf("\n")
+
+	fid1, err := os.Create(path.Join(conf.Path, "darkspot_screen.csv.gz"))
+	if err != nil {
+		panic(err)
+	}
+	defer fid1.Close()
+	smry := gzip.NewWriter(fid1)
+	defer smry.Close()
+	write_line(smry, "index,darkspot,nobs,mean,sd,lit_frac,trend,excluded\n")
+
+	var black *bufio.Writer
+	if conf.DSBlacklistFile != "" {
+		fid2, err := os.Create(path.Join(conf.Path, conf.DSBlacklistFile))
+		if err != nil {
+			panic(err)
+		}
+		defer fid2.Close()
+		black = bufio.NewWriter(fid2)
+		defer black.Flush()
+		write_line(black, "index,darkspot,reason\n")
+	}
+
+	var nscreen, nblack, nmean, nlit, ntrend int
+	for i, key := range ds_keys {
+
+		n := stats.n[i]
+		mean := math.NaN()
+		sd := math.NaN()
+		lit_frac := math.NaN()
+		trend := math.NaN()
+		if n > 0 {
+			mean = stats.my[i]
+			if n > 1 {
+				sd = math.Sqrt(stats.syy[i] / (n - 1))
+			}
+			lit_frac = stats.nlit[i] / n
+			if stats.stt[i] > 0 {
+				trend = stats.sty[i] / stats.stt[i]
+			}
+		}
+
+		var reasons []string
+		if int(n) >= conf.ScreenMinObs && n > 0 {
+			nscreen++
+			if conf.ScreenMaxMean > 0 && mean > conf.ScreenMaxMean {
+				reasons = append(reasons, "mean")
+				nmean++
+			}
+			if conf.ScreenMaxLitFrac > 0 && lit_frac > conf.ScreenMaxLitFrac {
+				reasons = append(reasons, "lit")
+				nlit++
+			}
+			if conf.ScreenMaxTrend > 0 && trend > conf.ScreenMaxTrend {
+				reasons = append(reasons, "trend")
+				ntrend++
+			}
+		}
+
+		excluded := 0
+		if len(reasons) > 0 {
+			excluded = 1
+			nblack++
+		}
+		if excluded == 1 && black != nil {
+			write_line(black, "%d,%s,%s\n", i, key, strings.Join(reasons, "+"))
+		}
+		write_line(smry, "%d,%s,%.0f,%.4f,%.4f,%.4f,%.4f,%d\n", i, key, n, mean, sd, lit_frac, trend, excluded)
+	}
+
+	msg := fmt.Sprintf("%d darkspots, %d screened, %d blacklisted (mean: %d, lit: %d, trend: %d)\n",
+		len(ds_keys), nscreen, nblack, nmean, nlit, ntrend)
+	logger.Print(msg)
+	fmt.Print(msg)
+
+	// Write empty file to signal completion.
+	fname = path.Join(conf.Path, "screen_darkspots_done")
+	fid3, err := os.Create(fname)
+	if err != nil {
+		panic(err)
+	}
+	fid3.Close()
+}
@@ -1,7 +1,12 @@
 package main
 
 // subtract walks the villages directory and subtracts the background
-// values from each village's vis values.
+// values from each village's vis values.  If background applies a
+// minimum support rule (conf.BgMinValid or conf.BgMinValidFrac), the
+// adjusted values for villages whose background is flagged in
+// "bgflag_##.gz" are set to NaN.  The flag files must exist in this
+// case, so background and subtract must be run with the same
+// configuration.
 //
 // Run subtract after running background.
 
@@ -14,7 +19,6 @@ import (
 	"sync"
 
 	lights "github.com/kshedden/indialights"
-	"github.com/kshedden/ziparray"
 )
 
 var (
@@ -42,6 +46,8 @@ func main() {
 	vi_basepath = path.Join(conf.Path, vi_basepath)
 	dir_names := lights.GetDirNames(vi_basepath)
 
+	use_flags := conf.BgMinValid > 0 || conf.BgMinValidFrac > 0
+
 	var wg sync.WaitGroup
 	sem := make(chan bool, 30)
 
@@ -58,7 +64,7 @@ func main() {
 				defer func() { <-sem }()
 
 				fname := path.Join(dir, fmt.Sprintf("background_%02d.gz", chunk_idx))
-				bg_data, err := ziparray.ReadFloat64Array(fname)
+				bg_data, err := lights.ReadColumn(fname)
 				if err != nil {
 					logger.Print(err)
 					logger.Print(dir)
@@ -66,7 +72,7 @@ func main() {
 				}
 
 				fname = path.Join(dir, fmt.Sprintf("vis_observed_%02d.gz", chunk_idx))
-				vi_data, err := ziparray.ReadFloat64Array(fname)
+				vi_data, err := lights.ReadColumn(fname)
 				if err != nil {
 					logger.Print(err)
 					logger.Print(dir)
@@ -79,14 +85,36 @@ func main() {
 					return
 				}
 
+				// Reasons that the background is missing, if any
+				var flags []float64
+				if use_flags {
+					fname = path.Join(dir, fmt.Sprintf("bgflag_%02d.gz", chunk_idx))
+					flags, err = lights.ReadColumn(fname)
+					if os.IsNotExist(err) {
+						msg := fmt.Sprintf("%s does not exist, background must be run with the same BgMinValid and BgMinValidFrac as subtract", fname)
+						panic(msg)
+					} else if err != nil {
+						logger.Print(err)
+						logger.Print(dir)
+						return
+					}
+				}
+				if use_flags && len(flags) != len(vi_data) {
+					logger.Print("mismatched flag lengths\n")
+					logger.Print(dir)
+					return
+				}
+
 				for i := 0; i < len(vi_data); i++ {
-					if !math.IsNaN(vi_data[i]) {
+					if flags != nil && flags[i] != lights.BgOK {
+						vi_data[i] = math.NaN()
+					} else if !math.IsNaN(vi_data[i]) {
 						vi_data[i] -= bg_data[i]
 					}
 				}
 
 				fname = path.Join(dir, fmt.Sprintf("vis_adjusted_%02d.gz", chunk_idx))
-				err = ziparray.WriteFloat64Array(vi_data, fname)
+				err = lights.WriteColumn(vi_data, fname, conf.SparseDensity)
 				if err != nil {
 					logger.Print(err)
 					logger.Print(dir)
@@ -77,7 +77,7 @@ func test1() {
 
 		fname = fmt.Sprintf("vis_observed_%02d.gz", bucket)
 		fname = path.Join(conf.Path, conf.ViBaseDir, year, month, day, fname)
-		vec, err := ziparray.ReadFloat64Array(fname)
+		vec, err := lights.ReadColumn(fname)
 		if err != nil {
 			panic(err)
 		}
@@ -118,7 +118,7 @@ func test2() {
 
 		fname = fmt.Sprintf("vis_observed_%02d.gz", chunk_idx)
 		fname = path.Join(conf.Path, conf.ViBaseDir, year, month, day, fname)
-		avec, err := ziparray.ReadFloat64Array(fname)
+		avec, err := lights.ReadColumn(fname)
 		if err != nil {
 			panic(err)
 		}
@@ -156,7 +156,7 @@ func test3() {
 	for _, dir := range dir_names {
 
 		fname := path.Join(dir, "vis_observed_00.gz")
-		obs, err := ziparray.ReadFloat64Array(fname)
+		obs, err := lights.ReadColumn(fname)
 		if os.IsNotExist(err) {
 			continue
 		}
@@ -164,7 +164,7 @@ func test3() {
 			panic(err)
 		}
 		fname = path.Join(dir, "background_00.gz")
-		bg, err := ziparray.ReadFloat64Array(fname)
+		bg, err := lights.ReadColumn(fname)
 		if os.IsNotExist(err) {
 			continue
 		}